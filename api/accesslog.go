@@ -0,0 +1,337 @@
+package api
+
+import (
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	AccessLogEnabled       = true               // 是否记录访问日志
+	AccessLogRetention     = 7 * 24 * time.Hour // 访问日志保留的时间，0表示不限制
+	AccessLogMaxRows       = 1000000            // 访问日志最多保留的条数，0表示不限制
+	AccessLogFlushInterval = 5 * time.Second    // 访问日志写库的间隔
+	AccessLogBatchSize     = 500                // 待写入的日志数量达到后立即写库
+	AccessLogPruneInterval = time.Hour          // 按照保留策略清理的间隔
+	AccessLogMaxPageSize   = 1000               // 查询访问日志每页最多的条数
+
+	accessLogs = newAccessLogWriter() // 全局的访问日志写入
+)
+
+// accessLogWriter 访问日志的异步批量写入，队列满的时候丢弃，不影响代理请求
+type accessLogWriter struct {
+	ch       chan *models.AccessLog
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	pending  []*models.AccessLog
+}
+
+func newAccessLogWriter() *accessLogWriter {
+	w := &accessLogWriter{
+		ch:       make(chan *models.AccessLog, 10000),
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// record 记录一条访问日志
+func (w *accessLogWriter) record(l *models.AccessLog) {
+	if !AccessLogEnabled {
+		return
+	}
+	select {
+	case w.ch <- l:
+	case <-w.quit:
+	default:
+		log.Println("[WARNING] access log queue is full, drop log of host:", l.Host)
+	}
+}
+
+func (w *accessLogWriter) add(l *models.AccessLog) {
+	w.pending = append(w.pending, l)
+	if len(w.pending) >= AccessLogBatchSize {
+		w.flush()
+	}
+}
+
+func (w *accessLogWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(AccessLogFlushInterval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(AccessLogPruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case l := <-w.ch:
+			w.add(l)
+		case <-ticker.C:
+			w.flush()
+		case <-pruneTicker.C:
+			w.flush()
+			pruneAccessLogs()
+		case req := <-w.flushReq:
+			w.drain()
+			w.flush()
+			close(req)
+		case <-w.quit:
+			w.drain()
+			w.flush()
+			return
+		}
+	}
+}
+
+// drain 取出队列中剩余的日志
+func (w *accessLogWriter) drain() {
+	for {
+		select {
+		case l := <-w.ch:
+			w.add(l)
+		default:
+			return
+		}
+	}
+}
+
+// flush 批量写入数据库，失败的丢弃，避免一直堆积
+func (w *accessLogWriter) flush() {
+	if len(w.pending) == 0 || models.GetDB() == nil {
+		return
+	}
+	if err := models.GetDB().CreateInBatches(w.pending, 100).Error; err != nil {
+		log.Println("[WARNING] flush access logs failed:", err)
+	}
+	w.pending = nil
+}
+
+// flushWait 立即写入数据库，返回时已经写完
+func (w *accessLogWriter) flushWait() {
+	req := make(chan struct{})
+	select {
+	case w.flushReq <- req:
+		<-req
+	case <-w.done:
+	}
+}
+
+// stop 停止并且写入剩余的日志
+func (w *accessLogWriter) stop() {
+	w.stopOnce.Do(func() {
+		close(w.quit)
+	})
+	<-w.done
+}
+
+// pruneAccessLogs 删除超过保留时间以及超过保留条数的日志
+func pruneAccessLogs() {
+	db := models.GetDB()
+	if db == nil {
+		return
+	}
+	if AccessLogRetention > 0 {
+		if err := db.Where("created_at < ?", time.Now().Add(-AccessLogRetention)).Delete(&models.AccessLog{}).Error; err != nil {
+			log.Println("[WARNING] prune access logs failed:", err)
+		}
+	}
+	if AccessLogMaxRows > 0 {
+		var ids []uint
+		db.Model(&models.AccessLog{}).Order("id desc").Offset(AccessLogMaxRows).Limit(1).Pluck("id", &ids)
+		if len(ids) > 0 {
+			if err := db.Where("id <= ?", ids[0]).Delete(&models.AccessLog{}).Error; err != nil {
+				log.Println("[WARNING] prune access logs failed:", err)
+			}
+		}
+	}
+}
+
+// accessLogOf 开始记录一个请求
+func accessLogOf(uid uint, method, addr string) *models.AccessLog {
+	return &models.AccessLog{
+		CreatedAt: time.Now(),
+		UserID:    uid,
+		Host:      hostOfAddr(addr),
+		Method:    method,
+	}
+}
+
+// finishAccessLog 请求结束，补全结果并且写入
+func finishAccessLog(l *models.AccessLog, status int, p *models.Proxy, err error) {
+	l.Status = status
+	if p != nil {
+		l.ProxyID = p.ID
+	}
+	if err != nil {
+		l.Error = err.Error()
+	}
+	l.Duration = time.Since(l.CreatedAt).Milliseconds()
+	accessLogs.record(l)
+}
+
+// errorStatus 请求失败时返回给客户端的响应码
+func errorStatus(err error) int {
+	switch err {
+	case errCoolingDown:
+		return http.StatusServiceUnavailable
+	case errQuotaExceeded, errTooManyConns:
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// countingConn 统计隧道收发的字节数，按批次计入用户的用量，关闭时写入访问日志
+type countingConn struct {
+	net.Conn
+	counter usageCounter
+	in, out int64
+	once    sync.Once
+	onClose func(in, out int64)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	c.counter.add(n)
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	c.counter.add(n)
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	err := c.Conn.Close()
+	c.counter.flush()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			c.onClose(atomic.LoadInt64(&c.in), atomic.LoadInt64(&c.out))
+		}
+	})
+	return err
+}
+
+// countingBody 统计响应内容的字节数，按批次计入用户的用量，关闭时写入访问日志
+type countingBody struct {
+	io.ReadCloser
+	counter usageCounter
+	n       int64
+	once    sync.Once
+	onClose func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	b.counter.add(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.counter.flush()
+	b.once.Do(func() {
+		b.onClose(b.n)
+	})
+	return err
+}
+
+// accessLogsHandler 查询当前用户的访问日志，支持按照时间范围、域名和响应码过滤
+// from/to为RFC3339格式或者unix时间戳
+func accessLogsHandler(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "10"))
+	if err != nil || size < 1 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	if size > AccessLogMaxPageSize {
+		size = AccessLogMaxPageSize
+	}
+
+	db := models.GetDB().Model(&models.AccessLog{}).Where("user_id = ?", userId(c))
+	for _, key := range []string{"from", "to"} {
+		v := c.Query(key)
+		if v == "" {
+			continue
+		}
+		t, err := parseTime(v)
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"code":    400,
+				"message": fmt.Sprintf("invalid %s: %v", key, err),
+			})
+			return
+		}
+		if key == "from" {
+			db = db.Where("created_at >= ?", t)
+		} else {
+			db = db.Where("created_at < ?", t)
+		}
+	}
+	if host := c.Query("host"); host != "" {
+		db = db.Where("host = ?", host)
+	}
+	if v := c.Query("status"); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(200, map[string]interface{}{
+				"code":    400,
+				"message": fmt.Sprintf("invalid status: %v", err),
+			})
+			return
+		}
+		db = db.Where("status = ?", status)
+	}
+
+	var count int64
+	var list []models.AccessLog
+	err = db.Count(&count).Error
+	if err == nil {
+		err = db.Offset((page - 1) * size).Limit(size).Order("id desc").Find(&list).Error
+	}
+	if err != nil {
+		c.JSON(200, map[string]interface{}{
+			"code":    500,
+			"message": fmt.Sprintf("access log list failed: %v", err),
+		})
+		return
+	}
+
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"lists": list,
+			"page":  page,
+			"size":  size,
+			"total": count,
+		},
+	})
+}
+
+// parseTime 解析RFC3339格式或者unix时间戳
+func parseTime(v string) (time.Time, error) {
+	if ts, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(ts, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
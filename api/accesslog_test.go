@@ -0,0 +1,135 @@
+package api
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyServeHTTP_accessLog(t *testing.T) {
+	setupTestDB(t)
+
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http ok"))
+	}))
+	defer httpTarget.Close()
+	httpsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer httpsTarget.Close()
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	p := &models.Proxy{IP: host, Port: portNum, ProxyType: "http", ProxyURL: upstream.URL, Http: true, Connect: true}
+	user := addTestUserProxy(t, "a@b.com", "1234", p)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	transport := &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	client := &http.Client{Transport: transport}
+	get := func(u string, header map[string]string) int {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get(httpTarget.URL, nil))
+	assert.Equal(t, http.StatusNotFound, get(httpsTarget.URL, nil))
+	assert.Equal(t, http.StatusInternalServerError, get(httpTarget.URL, map[string]string{"X-Rproxy-Filter": "country=xx"}))
+	// 隧道关闭后才记录
+	transport.CloseIdleConnections()
+
+	var logs []models.AccessLog
+	assert.Eventually(t, func() bool {
+		accessLogs.flushWait()
+		logs = nil
+		models.GetDB().Order("id").Find(&logs)
+		return len(logs) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+	if len(logs) != 3 {
+		return
+	}
+	byMethod := map[string][]models.AccessLog{}
+	for _, l := range logs {
+		assert.Equal(t, user.ID, l.UserID)
+		assert.Equal(t, "127.0.0.1", l.Host)
+		byMethod[l.Method] = append(byMethod[l.Method], l)
+	}
+	assert.Len(t, byMethod[http.MethodGet], 2)
+	assert.Len(t, byMethod[http.MethodConnect], 1)
+	for _, l := range byMethod[http.MethodGet] {
+		if l.Status == http.StatusOK {
+			assert.Equal(t, p.ID, l.ProxyID)
+			assert.Equal(t, int64(len("http ok")), l.BytesIn)
+		} else {
+			assert.Equal(t, http.StatusInternalServerError, l.Status)
+			assert.Equal(t, uint(0), l.ProxyID)
+			assert.Equal(t, errNoAliveProxy.Error(), l.Error)
+		}
+	}
+	tunnel := byMethod[http.MethodConnect][0]
+	assert.Equal(t, p.ID, tunnel.ProxyID)
+	assert.Greater(t, tunnel.BytesIn, int64(0))
+	assert.Greater(t, tunnel.BytesOut, int64(0))
+
+	// 查询接口
+	search := func(query string, uid uint) []models.AccessLog {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/logs?"+query, nil)
+		c.Set(authUserId, uid)
+		accessLogsHandler(c)
+		var result struct {
+			Code int
+			Data struct {
+				Lists []models.AccessLog
+				Total int64
+			}
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+		assert.Equal(t, 200, result.Code, w.Body.String())
+		assert.Equal(t, int64(len(result.Data.Lists)), result.Data.Total)
+		return result.Data.Lists
+	}
+	assert.Len(t, search("host=127.0.0.1", user.ID), 3)
+	assert.Len(t, search("status=500", user.ID), 1)
+	assert.Len(t, search("host=127.0.0.1", user.ID+1), 0)
+	assert.Len(t, search("from="+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), user.ID), 0)
+	assert.Len(t, search("to="+time.Now().Add(time.Hour).Format(time.RFC3339), user.ID), 3)
+
+	// 每页的条数有上限
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/logs?size=10000000", nil)
+	c.Set(authUserId, user.ID)
+	accessLogsHandler(c)
+	var result map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, float64(AccessLogMaxPageSize), result["data"].(map[string]interface{})["size"])
+
+	// 按照条数清理
+	defer func(n int) { AccessLogMaxRows = n }(AccessLogMaxRows)
+	AccessLogMaxRows = 1
+	pruneAccessLogs()
+	var count int64
+	models.GetDB().Model(&models.AccessLog{}).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
@@ -15,6 +15,8 @@ import (
 	"gorm.io/gorm"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -28,6 +30,7 @@ var (
 	Prefix      = "/api"
 	authUserKey = "token"  // 存在context中的token主键
 	authUserId  = "userId" // 存在context中的token主键
+	authOptsKey = "opts"   // 存在context中的用户名携带的代理选项
 	lock        sync.Mutex // 写入锁
 
 	authHeader = func(h http.Header) string {
@@ -39,9 +42,9 @@ var (
 			}
 			if strings.Contains(pa, " ") {
 				authToken := strings.Split(pa, " ")
-				var up [100]byte
-				if n, err := base64.StdEncoding.Decode(up[:], []byte(authToken[1])); err == nil {
-					authLine = string(up[:n]) // 天坑，必须要up[:n]的形式，不然后面的字符串就错了（看起来是一摸一样，实际内容不一样）
+				// 用户名可能带有代理选项，长度不固定
+				if up, err := base64.StdEncoding.DecodeString(authToken[1]); err == nil {
+					authLine = string(up)
 				}
 			}
 		}
@@ -49,19 +52,24 @@ var (
 	}
 
 	// TokenAuth 认证函数，可以覆盖
+	// 用户名可以携带代理选项，比如：user@a.com-country-us-type-socks5，选项去掉后再进行认证
+	// 先用完整的用户名认证，email中本身有像选项的部分时也能登录
 	TokenAuth = func(c *gin.Context, token string) bool {
-		var user models.User
-		info := strings.Split(token, ":")
+		info := strings.SplitN(token, ":", 2)
 		if len(info) < 2 {
 			return false // 格式不对
 		}
-		err := models.GetDB().Where(&models.User{Email: info[0], Token: info[1]}).Find(&user).Error
-		if err == nil && user.ID > 0 {
-			//log.Println(user.Email, "auth ok")
-			c.Set(authUserKey, user.Email)
-			c.Set(authUserId, user.ID)
-
-			return true
+		for _, pu := range parseUsernames(info[0]) {
+			var user models.User
+			err := models.GetDB().Where(&models.User{Email: pu.email, Token: info[1]}).Find(&user).Error
+			if err == nil && user.ID > 0 {
+				//log.Println(user.Email, "auth ok")
+				c.Set(authUserKey, user.Email)
+				c.Set(authUserId, user.ID)
+				c.Set(authOptsKey, pu.opts)
+
+				return true
+			}
 		}
 		return false
 	}
@@ -77,6 +85,16 @@ func userId(c *gin.Context) uint {
 	return 0
 }
 
+// authOptions 获取用户名中携带的代理选项
+func authOptions(c *gin.Context) url.Values {
+	if v, exists := c.Get(authOptsKey); exists {
+		if opts, ok := v.(url.Values); ok {
+			return opts
+		}
+	}
+	return nil
+}
+
 func statusHandler(c *gin.Context) {
 	//c.JSON() c.IndentedJSON()
 	c.JSON(200, map[string]interface{}{
@@ -213,7 +231,6 @@ func loadRestApi(router *gin.Engine) {
 					Where("user_proxies.proxy_id>0 and user_proxies.user_id=?", uid)
 			}
 			panic("not valid user")
-			return models.GetDB().Model(&models.Proxy{})
 		}),
 		gorestful.WithQueryFunc(func(keyword string, q *gorm.DB, res *gorestful.Resource) *gorm.DB {
 			query := ""
@@ -235,6 +252,9 @@ func loadRestApi(router *gin.Engine) {
 			if err != nil {
 				return fmt.Errorf("delete failed: %v", err)
 			}
+			if pid, err := strconv.Atoi(fmt.Sprint(id)); err == nil {
+				index.removeUserProxy(userId(c), uint(pid))
+			}
 
 			return nil
 		}),
@@ -243,7 +263,7 @@ func loadRestApi(router *gin.Engine) {
 		}),
 		gorestful.WithApiRouterGroup(router.Group("/api", func(c *gin.Context) {
 			if claims := userInfo(c); claims != nil {
-				c.Set(authUserKey, claims.Token)
+				c.Set(authUserKey, claims.Username)
 				c.Set(authUserId, claims.UID)
 				return
 			}
@@ -252,10 +272,25 @@ func loadRestApi(router *gin.Engine) {
 				"code":    403,
 				"message": "invalid auth",
 			})
+		}, rateLimit(rateScopeApi), func(c *gin.Context) {
+			c.Next()
+			// 编辑代理后同步到索引
+			if c.Request.Method == http.MethodPost && c.Writer.Status() == http.StatusOK {
+				if pid, err := strconv.Atoi(c.Param("id")); err == nil {
+					index.reload(uint(pid))
+				}
+			}
 		})),
 		gorestful.WithID("proxies.id"),
 		gorestful.WithAfterInsert(func(c *gin.Context, id uint) error {
-			return models.GetDB().Save(&models.UserProxy{UserID: userId(c), ProxyID: id}).Error
+			if err := models.GetDB().Save(&models.UserProxy{UserID: userId(c), ProxyID: id}).Error; err != nil {
+				return err
+			}
+			if err := index.reload(id); err != nil {
+				return err
+			}
+			index.addUserProxy(userId(c), id)
+			return nil
 		}),
 		gorestful.WithAuthMiddle(am))
 	if err != nil {
@@ -303,40 +338,83 @@ func Start(addr string) error {
 	// 检查公网IP
 	checkproxy.GetPublicIP()
 
+	// 加载代理索引
+	if err := index.load(); err != nil {
+		return err
+	}
+	// 定时重新检测入库的代理
+	revalidator.start()
+
 	router := gin.Default()
 	router.NoRoute(defaultHandler)
 
 	pprof.Register(router, "dev/pprof") // http pprof, default is "debug/pprof"
 	router.GET("/status", statusHandler)
-	router.GET("/check", checkHandler)
+	router.GET("/check", rateLimit(rateScopeCheck), checkHandler)
 	//router.Any("/", statusHandler)
 
-	v1 := router.Group(Prefix+"/v1", agentTokenAuth())
+	// /check单独限速
+	check := router.Group(Prefix+"/v1", agentTokenAuth(), rateLimit(rateScopeCheck))
+	check.GET("/check", checkHandler)
+	check.POST("/check/jobs", checkJobSubmitHandler)
+	check.POST("/import", importHandler)
+	v1 := router.Group(Prefix+"/v1", agentTokenAuth(), rateLimit(rateScopeApi))
 	v1.GET("/me", meHandler)
 	v1.GET("/list", listHandler)
-	v1.GET("/check", checkHandler)
+	v1.GET("/bans", bansHandler)
+	v1.GET("/logs", accessLogsHandler)
+	v1.GET("/usage", usageHandler)
+	v1.GET("/export", exportHandler)
+	v1.GET("/check/jobs", checkJobsHandler)
+	v1.GET("/check/jobs/:id", checkJobHandler)
+	v1.GET("/check/jobs/:id/events", checkJobEventsHandler)
+	v1.GET("/check/events", checkEventsHandler)
 
 	loadRestApi(router)
 
+	if Socks5Addr != "" {
+		go func() {
+			if err := StartSocks5(Socks5Addr); err != nil {
+				log.Println("socks5 server failed:", err)
+			}
+		}()
+	}
+
 	log.Println("api server listened at:", addr)
 
+	srv = &http.Server{Addr: addr, Handler: router}
 	var err error
 	if EnableTls {
-		err = router.RunTLS(addr, "cert.pem", "key.pem")
-		if err != nil {
+		if err = httpscerts.Check("cert.pem", "key.pem"); err != nil {
 			if err = httpscerts.Generate("cert.pem", "key.pem", ""); err != nil {
 				panic(err)
 			}
 		}
-		err = router.RunTLS(addr, "cert.pem", "key.pem")
+		err = srv.ListenAndServeTLS("cert.pem", "key.pem")
 	} else {
-		err = router.Run(addr)
+		err = srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		// Stop主动关闭
+		return nil
 	}
 	return err
 }
 
-// Stop 停止服务器
+// Stop 停止服务器，等待正在进行的检查完成，并把统计数据写入数据库
 func Stop() error {
+	var err error
+	if srv != nil {
+		err = srv.Close()
+	}
+	StopSocks5()
+	// 关闭正在转发的隧道，收发的字节数计入用量
+	relays.closeWait()
+	stopCheckJobs()
+	revalidator.stop()
 	wp.StopWait()
-	return srv.Close()
+	stats.stop()
+	accessLogs.stop()
+	usage.stop()
+	return err
 }
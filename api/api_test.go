@@ -0,0 +1,63 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setupTestDB 准备测试用的数据库，测试结束后删除
+func setupTestDB(t *testing.T) {
+	dbfile := filepath.Join(os.TempDir(), time.Now().Format("20060102150405.000000.sqlite"))
+	t.Cleanup(func() {
+		// 客户端保持的隧道在这里关闭，转发结束后不会再访问数据库
+		relays.closeWait()
+		// 统计数据、访问日志和用量写入当前的数据库，不影响后面的测试
+		stats.flushWait()
+		accessLogs.flushWait()
+		usage.flushWait()
+		usage.reset()
+		// 代理id会在新的数据库中重复使用
+		bans.Flush()
+		reuseUsage.Flush()
+		rateBuckets.Flush()
+		if d, err := models.GetDB().DB(); err == nil {
+			d.Close()
+		}
+		os.Remove(dbfile)
+		os.Remove(dbfile + "-wal")
+		os.Remove(dbfile + "-shm")
+	})
+	db, err := models.SetupDB(dbfile + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)")
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	assert.Nil(t, index.load())
+}
+
+// addTestUserProxy 添加测试用户以及对应的代理
+func addTestUserProxy(t *testing.T, email, token string, ps ...*models.Proxy) *models.User {
+	user := &models.User{Email: email, Token: token}
+	assert.Nil(t, models.GetDB().Create(user).Error)
+	for _, p := range ps {
+		assert.Nil(t, insertProxyToDb(p, user.ID))
+	}
+	return user
+}
+
+// newTestProxyServer 启动测试用的代理服务，返回带有用户名密码的代理地址
+func newTestProxyServer(t *testing.T, email, token string) *url.URL {
+	router := gin.New()
+	router.NoRoute(defaultHandler)
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	proxyUrl, _ := url.Parse(srv.URL)
+	proxyUrl.User = url.UserPassword(email, token)
+	return proxyUrl
+}
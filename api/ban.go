@@ -0,0 +1,191 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// BanRules 判断代理被目标网站封禁的规则，在配置文件的ban节点下配置
+type BanRules struct {
+	Status   []int         `mapstructure:"status"`   // 响应码，比如403、429
+	Body     []string      `mapstructure:"body"`     // 响应内容的正则，比如(?i)captcha
+	Header   []string      `mapstructure:"header"`   // 响应头的规则，格式为Name: 正则，比如cf-mitigated: challenge
+	Reset    bool          `mapstructure:"reset"`    // 连接被重置也认为是被封禁
+	Cooldown time.Duration `mapstructure:"cooldown"` // 隔离的时间
+
+	body   []*regexp.Regexp
+	header []headerRule
+}
+
+// headerRule 响应头规则
+type headerRule struct {
+	Name  string
+	Value *regexp.Regexp
+}
+
+// proxyBan 代理在一个域名上的封禁状态
+type proxyBan struct {
+	ProxyID  uint      `json:"proxy_id"`
+	ProxyURL string    `json:"proxy_url"`
+	Domain   string    `json:"domain"`
+	Reason   string    `json:"reason"`
+	Until    time.Time `json:"until"`
+}
+
+var (
+	BanBodyLimit = 64 * 1024 // 检查响应内容时最多读取的字节数
+
+	errBanned = errors.New("proxy banned by target")
+
+	banRules     = &BanRules{Status: []int{http.StatusForbidden, http.StatusTooManyRequests}, Cooldown: 30 * time.Minute}
+	banRulesLock sync.RWMutex
+	bans         = cache.New(30*time.Minute, time.Minute) // 代理id和域名对应的封禁状态
+)
+
+// SetBanRules 设置封禁规则，编译其中的正则
+func SetBanRules(rules *BanRules) error {
+	for _, s := range rules.Body {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid ban body rule %s: %v", s, err)
+		}
+		rules.body = append(rules.body, re)
+	}
+	for _, s := range rules.Header {
+		kv := strings.SplitN(s, ":", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid ban header rule: %s", s)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return fmt.Errorf("invalid ban header rule %s: %v", s, err)
+		}
+		rules.header = append(rules.header, headerRule{Name: strings.TrimSpace(kv[0]), Value: re})
+	}
+
+	banRulesLock.Lock()
+	banRules = rules
+	banRulesLock.Unlock()
+	return nil
+}
+
+func currentBanRules() *BanRules {
+	banRulesLock.RLock()
+	defer banRulesLock.RUnlock()
+	return banRules
+}
+
+// check 检查响应是否命中规则，返回命中的原因；需要检查内容时会读取部分body，再放回去
+func (rules *BanRules) check(resp *http.Response) string {
+	for _, status := range rules.Status {
+		if resp.StatusCode == status {
+			return "status " + strconv.Itoa(status)
+		}
+	}
+	for _, rule := range rules.header {
+		for _, v := range resp.Header.Values(rule.Name) {
+			if rule.Value.MatchString(v) {
+				return "header " + rule.Name + ": " + v
+			}
+		}
+	}
+	if len(rules.body) > 0 && resp.Body != nil {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, int64(BanBodyLimit)))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		if err != nil {
+			return ""
+		}
+		for _, re := range rules.body {
+			if re.Match(data) {
+				return "body " + re.String()
+			}
+		}
+	}
+	return ""
+}
+
+// isConnReset 是否为连接被重置
+func isConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// banKey 域名统一小写，不带端口
+func banKey(pid uint, domain string) string {
+	return fmt.Sprintf("%d:%s", pid, strings.ToLower(domain))
+}
+
+// hostOfAddr 去掉地址中的端口
+func hostOfAddr(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// banProxy 隔离代理在这个域名上的使用，不影响其他网站
+func banProxy(pid uint, proxyURL, domain, reason string) {
+	cooldown := currentBanRules().Cooldown
+	if cooldown <= 0 {
+		return
+	}
+	bans.Set(banKey(pid, domain), &proxyBan{
+		ProxyID:  pid,
+		ProxyURL: proxyURL,
+		Domain:   strings.ToLower(domain),
+		Reason:   reason,
+		Until:    time.Now().Add(cooldown),
+	}, cooldown)
+	log.Printf("proxy %s banned by %s: %s", proxyURL, domain, reason)
+}
+
+// isBanned 代理在这个域名上是否被隔离
+func isBanned(pid uint, domain string) bool {
+	if domain == "" {
+		return false
+	}
+	_, found := bans.Get(banKey(pid, domain))
+	return found
+}
+
+// userBans 用户的代理的封禁状态，按照域名排序
+func userBans(uid uint) []*proxyBan {
+	var list []*proxyBan
+	for _, item := range bans.Items() {
+		b := item.Object.(*proxyBan)
+		if _, ok := index.get(uid, b.ProxyID); ok {
+			list = append(list, b)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Domain != list[j].Domain {
+			return list[i].Domain < list[j].Domain
+		}
+		return list[i].ProxyID < list[j].ProxyID
+	})
+	return list
+}
+
+// bansHandler 查看当前用户的代理被哪些域名封禁
+func bansHandler(c *gin.Context) {
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": userBans(userId(c)),
+	})
+}
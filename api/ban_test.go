@@ -0,0 +1,157 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanRules_check(t *testing.T) {
+	rules := &BanRules{
+		Status: []int{429},
+		Body:   []string{"(?i)captcha"},
+		Header: []string{"cf-mitigated: challenge"},
+	}
+	assert.Nil(t, SetBanRules(rules))
+	defer SetBanRules(&BanRules{Status: []int{http.StatusForbidden, http.StatusTooManyRequests}, Cooldown: 30 * time.Minute})
+
+	newResp := func(status int, header http.Header, body string) *http.Response {
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body))}
+	}
+
+	assert.Equal(t, "", rules.check(newResp(200, nil, "hello")))
+	assert.Equal(t, "status 429", rules.check(newResp(429, nil, "")))
+	assert.Equal(t, "header cf-mitigated: challenge",
+		rules.check(newResp(200, http.Header{"Cf-Mitigated": {"challenge"}}, "")))
+
+	// 检查内容后body还可以完整读取
+	resp := newResp(200, nil, "please solve the CAPTCHA")
+	assert.Equal(t, "body (?i)captcha", rules.check(resp))
+	data, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "please solve the CAPTCHA", string(data))
+
+	assert.NotNil(t, SetBanRules(&BanRules{Header: []string{"no-value"}}))
+	assert.NotNil(t, SetBanRules(&BanRules{Body: []string{"("}}))
+}
+
+func TestProxyServeHTTP_ban(t *testing.T) {
+	setupTestDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	// 被目标封禁的上游，总是返回403
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("blocked"))
+	}))
+	defer blocked.Close()
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+
+	newProxy := func(u string) *models.Proxy {
+		host, port, _ := net.SplitHostPort(strings.TrimPrefix(u, "http://"))
+		p, _ := strconv.Atoi(port)
+		return &models.Proxy{IP: host, Port: p, ProxyType: "http", ProxyURL: u, Http: true}
+	}
+	blockedProxy := newProxy(blocked.URL)
+	goodProxy := newProxy(upstream.URL)
+	user := addTestUserProxy(t, "a@b.com", "1234", blockedProxy, goodProxy)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	get := func(retries string) (int, string) {
+		rrLock.Lock()
+		rrPositions = map[uint]int{}
+		rrLock.Unlock()
+
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		req.Header.Set("X-Rproxy-Strategy", "roundrobin")
+		req.Header.Set("X-Rproxy-Limit", "1")
+		req.Header.Set("X-Rproxy-Retries", retries)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		d, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(d)
+	}
+
+	// 先选到被封禁的代理，隔离后换代理重试
+	code, body := get("1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+	assert.True(t, isBanned(blockedProxy.ID, "127.0.0.1"))
+	assert.False(t, isBanned(blockedProxy.ID, "example.com"))
+
+	// 被隔离的代理不再用于这个域名，不重试也能成功
+	code, _ = get("0")
+	assert.Equal(t, http.StatusOK, code)
+
+	// 被封禁不影响代理的评分
+	p, _ := index.get(user.ID, blockedProxy.ID)
+	assert.Equal(t, 0, p.FailedCount)
+
+	// 通过api查看
+	list := userBans(user.ID)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "status 403", list[0].Reason)
+	d, err := json.Marshal(list)
+	assert.Nil(t, err)
+	assert.Contains(t, string(d), `"domain":"127.0.0.1"`)
+	assert.Len(t, userBans(user.ID+1), 0)
+}
+
+func TestProxyServeHTTP_banNoRetry(t *testing.T) {
+	setupTestDB(t)
+
+	// 封禁的响应内容比较大，不重试的时候要完整返回给客户端
+	body := strings.Repeat("x", 1<<20)
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(body))
+	}))
+	defer blocked.Close()
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(blocked.URL, "http://"))
+	p, _ := strconv.Atoi(port)
+	blockedProxy := &models.Proxy{IP: host, Port: p, ProxyType: "http", ProxyURL: blocked.URL, Http: true}
+	addTestUserProxy(t, "a@b.com", "1234", blockedProxy)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Rproxy-Retries", "0")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	d, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, len(body), len(d))
+	assert.True(t, isBanned(blockedProxy.ID, "example.com"))
+
+	// 重试次数用完也一样
+	req, _ = http.NewRequest(http.MethodGet, "http://example.org/", nil)
+	req.Header.Set("X-Rproxy-Retries", "3")
+	resp, err = client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	d, err = io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, len(body), len(d))
+}
@@ -10,6 +10,7 @@ import (
 	"gorm.io/gorm/clause"
 	"log"
 	"net"
+	"net/url"
 	"strings"
 	"time"
 )
@@ -72,21 +73,31 @@ func checkProxyOfUrl(checkResult *checkproxy.ProxyResult) *models.Proxy {
 }
 
 // insertProxyToDb 插入代理表，如果有用户信息，也要插入关联表
+// 已经存在的代理只更新属性，成功次数通过stats原子增加，避免覆盖并发的更新
 func insertProxyToDb(p *models.Proxy, uid uint) error {
 	var findProxy models.Proxy
-	if err := models.GetDB().Where(models.Proxy{ProxyURL: p.ProxyURL}).Find(&findProxy).Error; err == nil {
+	if err := models.GetDB().Where(models.Proxy{ProxyURL: p.ProxyURL}).Limit(1).Find(&findProxy).Error; err == nil && findProxy.ID > 0 {
 		p.ID = findProxy.ID
 		p.CreatedAt = findProxy.CreatedAt
-		p.SuccessCount = findProxy.SuccessCount + 1
+		if err = models.GetDB().Model(p).Select("*").Omit("CreatedAt", "SuccessCount", "FailedCount",
+			"LastSuccessTime", "LastFailedTime", "LastError").Updates(p).Error; err != nil {
+			return err
+		}
+		p.SuccessCount = findProxy.SuccessCount
 		p.FailedCount = findProxy.FailedCount
-		p.LastError = findProxy.LastError
+		p.LastSuccessTime = findProxy.LastSuccessTime
 		p.LastFailedTime = findProxy.LastFailedTime
+		p.LastError = findProxy.LastError
+		index.upsert(p)
+		stats.record(p.ID, nil, 0)
+	} else {
+		p.SuccessCount = 1
 		p.LastSuccessTime.Time = time.Now()
 		p.LastSuccessTime.Valid = true
-	}
-
-	if err := models.GetDB().Where(models.Proxy{ProxyURL: p.ProxyURL}).Save(p).Error; err != nil {
-		return err
+		if err := models.GetDB().Create(p).Error; err != nil {
+			return err
+		}
+		index.upsert(p)
 	}
 
 	// 写入关系表
@@ -97,6 +108,7 @@ func insertProxyToDb(p *models.Proxy, uid uint) error {
 		}).Error; err != nil {
 			return err
 		}
+		index.addUserProxy(uid, p.ID)
 	}
 
 	return nil
@@ -114,15 +126,69 @@ func fillProxyField(checkResult *checkproxy.ProxyResult, uid uint) {
 	}
 }
 
+// checkHostAndInsertDB 后台检测，结果推送给订阅的客户端
 func checkHostAndInsertDB(host string, uid uint) {
-	checkResult := checkproxy.CheckHost(host, afterCallback)
-	if checkResult == nil || !checkResult.Valid {
-		return
+	now := time.Now()
+	item := &checkItem{Target: host, StartedAt: &now}
+	r, err := checkTarget(host)
+	if err == nil && r != nil && r.Valid {
+		fillProxyField(r, uid)
+	}
+	item.setResult(r, err)
+	checkEvents.publish(uid, &checkEvent{checkItem: *item})
+}
+
+// checkAddrOf 要检测的代理地址，url或者host:port格式的取出host:port
+func checkAddrOf(v string) string {
+	if strings.Contains(v, "://") {
+		if u, err := url.Parse(v); err == nil {
+			return u.Host
+		}
 	}
-	fillProxyField(checkResult, uid)
+	return v
+}
+
+// checkTargetAddr 请求中要检测的代理地址，host:port格式
+func checkTargetAddr(c *gin.Context) string {
+	v := c.Query("url")
+	if v == "" {
+		v = c.Query("host")
+	}
+	if v == "" {
+		return net.JoinHostPort(c.Query("ip"), c.Query("port"))
+	}
+	return checkAddrOf(v)
 }
 
 func checkHandler(c *gin.Context) {
+	// ?ip=1.1.1.0/24&port=3128,8080,8000-8100 网段或者多个端口的扫描，作为任务在后台进行，只允许认证过的用户
+	if ip, port := c.Query("ip"), c.Query("port"); c.Query("url") == "" && c.Query("host") == "" &&
+		(strings.Contains(ip, "/") || strings.ContainsAny(ip+port, ",-")) {
+		if userId(c) == 0 {
+			c.JSON(200, map[string]interface{}{
+				"code":    403,
+				"message": errScanNeedsAuth.Error(),
+			})
+			return
+		}
+		scan, err := newScan(strings.Split(ip, ","), port)
+		if err != nil {
+			submitCheckJob(c, nil, err)
+			return
+		}
+		submitCheckJob(c, newScanJob(userId(c), scan), nil)
+		return
+	}
+
+	// 内网等不允许的地址直接拒绝，不进入后台检测
+	if err := checkproxy.CheckAddr(checkTargetAddr(c)); errors.Is(err, checkproxy.ErrForbiddenAddress) {
+		c.JSON(200, map[string]interface{}{
+			"code":    403,
+			"message": err.Error(),
+		})
+		return
+	}
+
 	var checkResult *checkproxy.ProxyResult
 	if proxyUrl := c.Query("url"); len(proxyUrl) > 0 {
 		// ?url=https://1.1.1.1:443
@@ -1,8 +1,14 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"github.com/LubyRuffy/rproxy/checkproxy"
 	"github.com/LubyRuffy/rproxy/models"
+	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -31,7 +37,7 @@ func TestStart_insertProxyToDb(t *testing.T) {
 		Http:         true,
 		Connect:      true,
 		Country:      "CN",
-		ProxyLevel:   models.ProxyAnonymityElite,
+		ProxyLevel:   checkproxy.ProxyAnonymityElite,
 		Latency:      10000000,
 		SuccessCount: 0,
 		FailedCount:  0,
@@ -64,3 +70,44 @@ func TestStart_insertProxyToDb(t *testing.T) {
 	assert.Nil(t, models.GetDB().Model(&models.UserProxy{}).Count(&size).Error)
 	assert.Equal(t, int64(1), size)
 }
+
+func TestCheckHandler_forbiddenAddress(t *testing.T) {
+	defer checkproxy.SetDialPolicy(true, nil, nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/check", checkHandler)
+	check := func(query string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/check?"+query, nil))
+		var v map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &v))
+		return v
+	}
+
+	for _, query := range []string{
+		"url=http://127.0.0.1:8080",
+		"host=169.254.169.254:80",
+		"host=socks5://[::1]:1080",
+		"ip=10.0.0.1&port=3128",
+	} {
+		v := check(query)
+		assert.Equal(t, float64(403), v["code"], query)
+		assert.Contains(t, v["message"], "forbidden address", query)
+	}
+
+	// 连接时也会检查
+	r := checkproxy.CheckUrl("http://127.0.0.1:1", nil)
+	assert.True(t, errors.Is(r.Error, checkproxy.ErrForbiddenAddress))
+
+	// allow优先
+	assert.Nil(t, checkproxy.SetDialPolicy(true, []string{"10.0.0.1"}, nil))
+	assert.Nil(t, checkproxy.CheckAddr("10.0.0.1:3128"))
+	assert.NotNil(t, checkproxy.CheckAddr("10.0.0.2:3128"))
+
+	// 关闭后都允许
+	assert.Nil(t, checkproxy.SetDialPolicy(false, nil, nil))
+	assert.Nil(t, checkproxy.CheckAddr("127.0.0.1:80"))
+
+	assert.NotNil(t, checkproxy.SetDialPolicy(true, []string{"bad"}, nil))
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	CheckEventsPing = 15 * time.Second // 推送检测结果时的心跳间隔，避免中间的代理断开空闲连接
+
+	checkEvents = &checkBroker{subs: map[*checkSubscriber]struct{}{}} // 全局的检测结果订阅
+)
+
+// checkEvent 推送给客户端的一个检测结果，Job为空表示/check?host=的后台检测
+type checkEvent struct {
+	Job string `json:"job,omitempty"`
+	checkItem
+}
+
+// checkSubscriber 一个客户端的订阅，job为空表示订阅用户所有的检测
+type checkSubscriber struct {
+	uid uint
+	job string
+	ch  chan *checkEvent
+}
+
+// checkBroker 把检测结果分发给订阅的客户端，客户端处理不过来时丢弃，不影响检测
+type checkBroker struct {
+	lock sync.Mutex
+	subs map[*checkSubscriber]struct{}
+}
+
+func (b *checkBroker) subscribe(uid uint, job string) *checkSubscriber {
+	s := &checkSubscriber{uid: uid, job: job, ch: make(chan *checkEvent, 1024)}
+	b.lock.Lock()
+	b.subs[s] = struct{}{}
+	b.lock.Unlock()
+	return s
+}
+
+func (b *checkBroker) unsubscribe(s *checkSubscriber) {
+	b.lock.Lock()
+	delete(b.subs, s)
+	b.lock.Unlock()
+}
+
+// publish 推送给用户对应的订阅
+func (b *checkBroker) publish(uid uint, e *checkEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for s := range b.subs {
+		if s.uid != uid || (s.job != "" && s.job != e.Job) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+}
+
+// streamCheckEvents 通过SSE推送检测结果，先推送replay中已经完成的结果
+// job不为空时，任务完成后推送done事件并结束
+func streamCheckEvents(c *gin.Context, s *checkSubscriber, replay []*checkEvent, job *checkJob) {
+	defer checkEvents.unsubscribe(s)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	for _, e := range replay {
+		c.SSEvent("result", e)
+	}
+	c.Writer.Flush()
+
+	var finished chan struct{}
+	if job != nil {
+		finished = job.finished
+	}
+	ping := time.NewTicker(CheckEventsPing)
+	defer ping.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e := <-s.ch:
+			c.SSEvent("result", e)
+			return true
+		case <-finished:
+			// 结束前推送剩余的结果
+			for {
+				select {
+				case e := <-s.ch:
+					c.SSEvent("result", e)
+				default:
+					c.SSEvent("done", job.summary())
+					return false
+				}
+			}
+		case <-ping.C:
+			c.SSEvent("ping", time.Now().Unix())
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// checkEventsHandler 推送当前用户所有的检测结果，包括/check?host=的后台检测和批量任务
+func checkEventsHandler(c *gin.Context) {
+	streamCheckEvents(c, checkEvents.subscribe(userId(c), ""), nil, nil)
+}
+
+// checkJobEventsHandler 推送一个任务的检测结果，已经完成的先推送
+func checkJobEventsHandler(c *gin.Context) {
+	job := userCheckJob(c)
+	if job == nil {
+		c.JSON(200, map[string]interface{}{
+			"code":    404,
+			"message": "job not found",
+		})
+		return
+	}
+
+	// 持有任务的锁，保证已经完成的和后续推送的结果不重复也不遗漏
+	job.lock.Lock()
+	s := checkEvents.subscribe(job.uid, job.id)
+	var replay []*checkEvent
+	for _, item := range job.items {
+		replay = append(replay, &checkEvent{Job: job.id, checkItem: *item})
+	}
+	job.lock.Unlock()
+
+	streamCheckEvents(c, s, replay, job)
+}
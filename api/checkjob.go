@@ -0,0 +1,513 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LubyRuffy/rproxy/checkproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 检测任务中每一项的状态
+const (
+	checkStatusPending = "pending" // 等待检测
+	checkStatusRunning = "running" // 正在检测
+	checkStatusValid   = "valid"   // 是代理，已经入库
+	checkStatusInvalid = "invalid" // 不是代理或者连接失败
+	checkStatusError   = "error"   // 地址不正确或者不允许检测
+	checkStatusSkipped = "skipped" // 最近已经检测过，命中缓存跳过
+)
+
+var (
+	MaxCheckJobTargets  = 10000           // 一个任务最多的检测目标数
+	MaxCheckJobBody     = int64(10 << 20) // 提交任务的请求体大小限制
+	CheckJobTTL         = 24 * time.Hour  // 任务在内存中保留的时间
+	CheckJobConcurrency = 20              // 每个任务同时检测的数量
+	MaxScanTargets      = 1 << 18         // 一个扫描任务展开后最多的地址数
+	MaxCheckJobsPerUser = 5               // 每个用户同时进行的任务数，0表示不限制
+
+	errCheckJobEmpty    = errors.New("no targets")
+	errTooManyCheckJobs = errors.New("too many running check jobs")
+	errScanNeedsAuth    = errors.New("scan requires a user token")
+
+	checkJobs     = cache.New(cache.NoExpiration, 10*time.Minute) // 任务id对应的*checkJob
+	checkJobsLock sync.Mutex
+	checkJobsQuit = make(chan struct{}) // 服务停止后不再提交
+)
+
+// checkItem 任务中一个检测目标的结果
+type checkItem struct {
+	Target     string                         `json:"target"`
+	Status     string                         `json:"status"`
+	Url        string                         `json:"url,omitempty"`   // 有效代理的完整地址
+	Error      string                         `json:"error,omitempty"` // 失败的原因
+	IP         string                         `json:"ip,omitempty"`    // 有效代理的出口ip
+	Connect    bool                           `json:"connect,omitempty"`
+	ProxyLevel checkproxy.ProxyAnonymityLevel `json:"proxy_level,omitempty"`
+	StartedAt  *time.Time                     `json:"started_at,omitempty"`
+	Cost       int64                          `json:"cost"` // 检测耗时，单位为毫秒
+}
+
+// setResult 记录检测的结果
+func (item *checkItem) setResult(r *checkproxy.ProxyResult, err error) {
+	item.Status, err = checkOutcome(r, err)
+	if err != nil {
+		item.Error = err.Error()
+	}
+	if item.Status == checkStatusValid {
+		item.Url = r.Url
+		item.IP = r.IP
+		item.Connect = r.SupportConnect
+		item.ProxyLevel = r.ProxyLevel
+	}
+	item.Cost = time.Since(*item.StartedAt).Milliseconds()
+}
+
+// checkJob 批量检测任务，目标按需取出，每个单独提交到工作池
+type checkJob struct {
+	lock       sync.Mutex
+	id         string
+	uid        uint
+	scan       bool // 网段扫描只保留有效的结果
+	createdAt  time.Time
+	finishedAt *time.Time
+	finished   chan struct{} // 所有项都检测完成后关闭
+	next       func() (string, bool)
+	total      int
+	items      []*checkItem // 已经完成的结果，按照完成的顺序
+	done       int
+	counts     map[string]int
+}
+
+// newCheckJobID 随机的任务id
+func newCheckJobID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newCheckJob(uid uint, targets []string) *checkJob {
+	i := 0
+	return &checkJob{
+		id:        newCheckJobID(),
+		uid:       uid,
+		createdAt: time.Now(),
+		finished:  make(chan struct{}),
+		next: func() (string, bool) {
+			if i >= len(targets) {
+				return "", false
+			}
+			i++
+			return targets[i-1], true
+		},
+		total:  len(targets),
+		counts: map[string]int{checkStatusPending: len(targets)},
+	}
+}
+
+// newScanJob 网段和端口的扫描任务，检测时才展开
+func newScanJob(uid uint, scan *checkproxy.Scan) *checkJob {
+	total := int(scan.Total())
+	return &checkJob{
+		id:        newCheckJobID(),
+		uid:       uid,
+		scan:      true,
+		createdAt: time.Now(),
+		finished:  make(chan struct{}),
+		next:      scan.Iter(),
+		total:     total,
+		counts:    map[string]int{checkStatusPending: total},
+	}
+}
+
+// recount 一项的状态从from变成to，更新各个状态的数量，需要持有锁
+func (j *checkJob) recount(from, to string) {
+	j.counts[from]--
+	if j.counts[from] == 0 {
+		delete(j.counts, from)
+	}
+	j.counts[to]++
+}
+
+// start 开始检测一项
+func (j *checkJob) start(target string) *checkItem {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	now := time.Now()
+	j.recount(checkStatusPending, checkStatusRunning)
+	return &checkItem{Target: target, Status: checkStatusRunning, StartedAt: &now}
+}
+
+// finish 一项检测结束，推送给订阅的客户端，所有项都结束后记录完成时间
+func (j *checkJob) finish(item *checkItem, r *checkproxy.ProxyResult, err error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	item.setResult(r, err)
+	j.recount(checkStatusRunning, item.Status)
+	if !j.scan || item.Status == checkStatusValid {
+		j.items = append(j.items, item)
+	}
+	checkEvents.publish(j.uid, &checkEvent{Job: j.id, checkItem: *item})
+
+	j.done++
+	if j.done == j.total {
+		now := time.Now()
+		j.finishedAt = &now
+		close(j.finished)
+	}
+}
+
+// summary 任务的进度
+func (j *checkJob) summary() map[string]interface{} {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	counts := make(map[string]int, len(j.counts))
+	for k, v := range j.counts {
+		counts[k] = v
+	}
+	return map[string]interface{}{
+		"id":          j.id,
+		"created_at":  j.createdAt,
+		"finished_at": j.finishedAt,
+		"scan":        j.scan,
+		"total":       j.total,
+		"done":        j.done,
+		"counts":      counts,
+	}
+}
+
+// list 按照状态过滤后分页的检测结果
+func (j *checkJob) list(status string, page, size int) ([]checkItem, int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var list []checkItem
+	total := 0
+	for _, item := range j.items {
+		if status != "" && item.Status != status {
+			continue
+		}
+		if total >= (page-1)*size && len(list) < size {
+			list = append(list, *item)
+		}
+		total++
+	}
+	return list, total
+}
+
+// checkTarget 检测一个目标，url格式的按照指定的协议，host:port格式的遍历协议
+func checkTarget(target string) (*checkproxy.ProxyResult, error) {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid url: %s", target)
+		}
+	}
+	// 地址不允许的直接返回错误，不进入检测
+	if err := checkproxy.CheckAddr(checkAddrOf(target)); err != nil {
+		return nil, err
+	}
+
+	if strings.Contains(target, "://") {
+		return checkproxy.CheckUrl(target, afterCallback), nil
+	}
+	return checkproxy.CheckHost(target, afterCallback), nil
+}
+
+// checkOutcome 检测结果对应的状态，以及失败的原因
+func checkOutcome(r *checkproxy.ProxyResult, err error) (string, error) {
+	switch {
+	case err != nil:
+		return checkStatusError, err
+	case r == nil:
+		return checkStatusInvalid, nil
+	case r.Valid:
+		return checkStatusValid, nil
+	case errors.Is(r.Error, checkproxy.ErrSkipped):
+		return checkStatusSkipped, nil
+	case errors.Is(r.Error, checkproxy.ErrForbiddenAddress):
+		return checkStatusError, r.Error
+	}
+	return checkStatusInvalid, r.Error
+}
+
+// run 检测任务的一项，有效的代理入库
+func (j *checkJob) run(target string) {
+	item := j.start(target)
+	r, err := checkTarget(target)
+	if err == nil && r != nil && r.Valid {
+		fillProxyField(r, j.uid)
+	}
+	j.finish(item, r, err)
+}
+
+// runningCheckJobs 用户还没有完成的任务数，需要持有checkJobsLock
+func runningCheckJobs(uid uint) int {
+	n := 0
+	for _, v := range checkJobs.Items() {
+		job := v.Object.(*checkJob)
+		if job.uid != uid {
+			continue
+		}
+		job.lock.Lock()
+		if job.finishedAt == nil {
+			n++
+		}
+		job.lock.Unlock()
+	}
+	return n
+}
+
+// submit 按需取出目标提交到工作池，每个任务同时检测的数量不超过CheckJobConcurrency，跟/check共用工作池
+// 用户同时进行的任务超过MaxCheckJobsPerUser时不提交
+func (j *checkJob) submit() error {
+	checkJobsLock.Lock()
+	if MaxCheckJobsPerUser > 0 && runningCheckJobs(j.uid) >= MaxCheckJobsPerUser {
+		checkJobsLock.Unlock()
+		return errTooManyCheckJobs
+	}
+	checkJobs.Set(j.id, j, CheckJobTTL)
+	checkJobsLock.Unlock()
+
+	go func() {
+		sem := make(chan struct{}, CheckJobConcurrency)
+		for {
+			select {
+			case sem <- struct{}{}:
+			case <-checkJobsQuit:
+				return
+			}
+			target, ok := j.next()
+			if !ok {
+				return
+			}
+			if !submitCheck(func() {
+				defer func() { <-sem }()
+				j.run(target)
+			}) {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// submitCheck 提交到工作池，服务停止后返回false
+func submitCheck(task func()) bool {
+	checkJobsLock.Lock()
+	defer checkJobsLock.Unlock()
+	select {
+	case <-checkJobsQuit:
+		return false
+	default:
+	}
+	wp.Submit(task)
+	return true
+}
+
+// stopCheckJobs 停止提交任务中剩余的目标
+func stopCheckJobs() {
+	checkJobsLock.Lock()
+	defer checkJobsLock.Unlock()
+	select {
+	case <-checkJobsQuit:
+	default:
+		close(checkJobsQuit)
+	}
+}
+
+// parseCheckTargets 解析提交的检测目标，json格式为{"targets":[...]}或者数组，其他的按行分割，忽略空行和#开头的注释
+func parseCheckTargets(contentType string, body []byte) ([]string, error) {
+	var list []string
+	if strings.Contains(contentType, "json") {
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && body[0] == '[' {
+			if err := json.Unmarshal(body, &list); err != nil {
+				return nil, err
+			}
+		} else {
+			var v struct {
+				Targets []string `json:"targets"`
+			}
+			if err := json.Unmarshal(body, &v); err != nil {
+				return nil, err
+			}
+			list = v.Targets
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			list = append(list, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var targets []string
+	for _, t := range list {
+		t = strings.TrimSpace(t)
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, errCheckJobEmpty
+	}
+	if len(targets) > MaxCheckJobTargets {
+		return nil, fmt.Errorf("too many targets: %d > %d", len(targets), MaxCheckJobTargets)
+	}
+	return targets, nil
+}
+
+// newScan 网段和端口的扫描，展开后的数量不能超过MaxScanTargets
+func newScan(cidrs []string, ports string) (*checkproxy.Scan, error) {
+	scan, err := checkproxy.NewScan(cidrs, ports)
+	if err != nil {
+		return nil, err
+	}
+	if scan.Total() > uint64(MaxScanTargets) {
+		return nil, fmt.Errorf("too many targets: %d > %d", scan.Total(), MaxScanTargets)
+	}
+	return scan, nil
+}
+
+// parseCheckJob 解析提交的任务，json中有cidrs的为扫描任务：{"cidrs":["1.1.1.0/24"],"ports":"3128,8080,1080"}
+func parseCheckJob(uid uint, contentType string, body []byte) (*checkJob, error) {
+	if strings.Contains(contentType, "json") {
+		var v struct {
+			Cidrs []string `json:"cidrs"`
+			Ports string   `json:"ports"`
+		}
+		if err := json.Unmarshal(body, &v); err == nil && len(v.Cidrs) > 0 {
+			scan, err := newScan(v.Cidrs, v.Ports)
+			if err != nil {
+				return nil, err
+			}
+			return newScanJob(uid, scan), nil
+		}
+	}
+
+	targets, err := parseCheckTargets(contentType, body)
+	if err != nil {
+		return nil, err
+	}
+	return newCheckJob(uid, targets), nil
+}
+
+// submitCheckJob 提交任务并返回任务id
+func submitCheckJob(c *gin.Context, job *checkJob, err error) {
+	if err == nil {
+		err = job.submit()
+	}
+	if err != nil {
+		code := 400
+		if err == errTooManyCheckJobs {
+			code = 429
+		}
+		c.JSON(200, map[string]interface{}{
+			"code":    code,
+			"message": fmt.Sprintf("submit check job failed: %v", err),
+		})
+		return
+	}
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": job.summary(),
+	})
+}
+
+// checkJobSubmitHandler 批量提交检测，返回任务id，在后台检测
+func checkJobSubmitHandler(c *gin.Context) {
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxCheckJobBody))
+	if err != nil {
+		submitCheckJob(c, nil, err)
+		return
+	}
+	job, err := parseCheckJob(userId(c), c.ContentType(), body)
+	submitCheckJob(c, job, err)
+}
+
+// userCheckJob 当前用户的任务，其他用户的任务当做不存在
+func userCheckJob(c *gin.Context) *checkJob {
+	if v, found := checkJobs.Get(c.Param("id")); found {
+		if job := v.(*checkJob); job.uid == userId(c) {
+			return job
+		}
+	}
+	return nil
+}
+
+// checkJobHandler 查看任务的进度和每一项的结果，支持按照status过滤和分页
+func checkJobHandler(c *gin.Context) {
+	job := userCheckJob(c)
+	if job == nil {
+		c.JSON(200, map[string]interface{}{
+			"code":    404,
+			"message": "job not found",
+		})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	size, err := strconv.Atoi(c.DefaultQuery("size", "100"))
+	if err != nil || size < 1 {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	list, total := job.list(c.Query("status"), page, size)
+	data := job.summary()
+	data["items"] = map[string]interface{}{
+		"lists": list,
+		"page":  page,
+		"size":  size,
+		"total": total,
+	}
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": data,
+	})
+}
+
+// checkJobsHandler 当前用户的所有任务，新的在前
+func checkJobsHandler(c *gin.Context) {
+	var jobs []*checkJob
+	for _, v := range checkJobs.Items() {
+		if job := v.Object.(*checkJob); job.uid == userId(c) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].createdAt.After(jobs[j].createdAt)
+	})
+
+	list := make([]map[string]interface{}, 0, len(jobs))
+	for _, job := range jobs {
+		list = append(list, job.summary())
+	}
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": list,
+	})
+}
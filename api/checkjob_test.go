@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCheckTargets(t *testing.T) {
+	targets, err := parseCheckTargets("text/plain", []byte("1.1.1.1:80\n\n# comment\n socks5://2.2.2.2:1080 \n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.1.1.1:80", "socks5://2.2.2.2:1080"}, targets)
+
+	targets, err = parseCheckTargets("application/json", []byte(`{"targets":["1.1.1.1:80"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.1.1.1:80"}, targets)
+
+	targets, err = parseCheckTargets("application/json", []byte(` ["1.1.1.1:80", ""]`))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.1.1.1:80"}, targets)
+
+	_, err = parseCheckTargets("application/json", []byte(`{"targets":1}`))
+	assert.NotNil(t, err)
+	_, err = parseCheckTargets("text/plain", []byte("\n# comment\n"))
+	assert.Equal(t, errCheckJobEmpty, err)
+
+	old := MaxCheckJobTargets
+	MaxCheckJobTargets = 1
+	defer func() { MaxCheckJobTargets = old }()
+	_, err = parseCheckTargets("text/plain", []byte("1.1.1.1:80\n2.2.2.2:80"))
+	assert.Contains(t, err.Error(), "too many targets")
+}
+
+func TestCheckJob(t *testing.T) {
+	defer checkJobs.Flush()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	uid := uint(1)
+	auth := func(c *gin.Context) {
+		c.Set(authUserId, uid)
+	}
+	router.POST("/check/jobs", auth, checkJobSubmitHandler)
+	router.GET("/check/jobs", auth, checkJobsHandler)
+	router.GET("/check/jobs/:id", auth, checkJobHandler)
+	do := func(method, path, body string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		router.ServeHTTP(w, req)
+		var v map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &v))
+		return v
+	}
+
+	// 不允许的地址和错误的url不用连接，直接是error
+	v := do(http.MethodPost, "/check/jobs", "http://127.0.0.1:8080\n10.0.0.1:3128\nhttp://\n")
+	assert.Equal(t, float64(200), v["code"])
+	id := v["data"].(map[string]interface{})["id"].(string)
+	assert.Equal(t, float64(3), v["data"].(map[string]interface{})["total"])
+
+	var data map[string]interface{}
+	assert.Eventually(t, func() bool {
+		data = do(http.MethodGet, "/check/jobs/"+id, "")["data"].(map[string]interface{})
+		return data["finished_at"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(3), data["done"])
+	assert.Equal(t, map[string]interface{}{checkStatusError: float64(3)}, data["counts"])
+	items := data["items"].(map[string]interface{})
+	assert.Equal(t, float64(3), items["total"])
+	// 按照完成的顺序排列，顺序不固定
+	errs := map[string]string{}
+	for _, item := range items["lists"].([]interface{}) {
+		item := item.(map[string]interface{})
+		assert.Equal(t, checkStatusError, item["status"])
+		assert.NotEmpty(t, item["error"])
+		assert.NotNil(t, item["started_at"])
+		errs[item["target"].(string)] = item["error"].(string)
+	}
+	assert.Contains(t, errs["http://127.0.0.1:8080"], "forbidden address")
+	assert.Contains(t, errs["10.0.0.1:3128"], "forbidden address")
+
+	// 过滤和分页
+	items = do(http.MethodGet, "/check/jobs/"+id+"?status=error&page=2&size=2", "")["data"].(map[string]interface{})["items"].(map[string]interface{})
+	assert.Equal(t, float64(3), items["total"])
+	assert.Len(t, items["lists"], 1)
+	items = do(http.MethodGet, "/check/jobs/"+id+"?status=valid", "")["data"].(map[string]interface{})["items"].(map[string]interface{})
+	assert.Equal(t, float64(0), items["total"])
+
+	assert.Len(t, do(http.MethodGet, "/check/jobs", "")["data"], 1)
+	assert.Equal(t, float64(400), do(http.MethodPost, "/check/jobs", "")["code"])
+
+	// 其他用户看不到
+	uid = 2
+	assert.Equal(t, float64(404), do(http.MethodGet, "/check/jobs/"+id, "")["code"])
+	assert.Len(t, do(http.MethodGet, "/check/jobs", "")["data"], 0)
+}
+
+func TestCheckEvents(t *testing.T) {
+	defer checkJobs.Flush()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	auth := func(c *gin.Context) {
+		c.Set(authUserId, uint(1))
+	}
+	router.GET("/check/events", auth, checkEventsHandler)
+	router.GET("/check/jobs/:id/events", auth, checkJobEventsHandler)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	// 订阅所有的检测结果，只收到自己的
+	resp, err := http.Get(srv.URL + "/check/events")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	assert.Eventually(t, func() bool {
+		checkEvents.lock.Lock()
+		defer checkEvents.lock.Unlock()
+		return len(checkEvents.subs) == 1
+	}, time.Second, 10*time.Millisecond)
+	checkHostAndInsertDB("127.0.0.1:8080", 2)
+	checkHostAndInsertDB("127.0.0.1:8080", 1)
+	r := bufio.NewReader(resp.Body)
+	line, err := r.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "event:result\n", line)
+	line, err = r.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Contains(t, line, `"target":"127.0.0.1:8080","status":"error"`)
+
+	// 一个任务的结果，完成后结束
+	job := newCheckJob(1, []string{"http://127.0.0.1:8080", "10.0.0.1:3128"})
+	assert.Nil(t, job.submit())
+	resp, err = http.Get(srv.URL + "/check/jobs/" + job.id + "/events")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, strings.Count(string(body), "event:result\n"))
+	assert.Equal(t, 1, strings.Count(string(body), "event:done\n"))
+	assert.Contains(t, string(body), job.id)
+}
+
+func TestScanJob(t *testing.T) {
+	defer checkJobs.Flush()
+
+	scan, err := newScan([]string{"1.2.3.254/31", "5.5.5.5"}, "80,8000-8001")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(9), scan.Total())
+	var hosts []string
+	next := scan.Iter()
+	for host, ok := next(); ok; host, ok = next() {
+		hosts = append(hosts, host)
+	}
+	assert.Equal(t, []string{
+		"1.2.3.254:80", "1.2.3.254:8000", "1.2.3.254:8001",
+		"1.2.3.255:80", "1.2.3.255:8000", "1.2.3.255:8001",
+		"5.5.5.5:80", "5.5.5.5:8000", "5.5.5.5:8001",
+	}, hosts)
+
+	_, err = newScan([]string{"1.0.0.0/8"}, "80")
+	assert.Contains(t, err.Error(), "too many targets")
+	_, err = newScan([]string{"::/64"}, "80")
+	assert.Contains(t, err.Error(), "too large")
+	_, err = newScan([]string{"1.1.1.1"}, "0-10")
+	assert.NotNil(t, err)
+
+	job, err := parseCheckJob(1, "application/json", []byte(`{"cidrs":["1.1.1.0/30"],"ports":"80"}`))
+	assert.Nil(t, err)
+	assert.True(t, job.scan)
+	assert.Equal(t, 4, job.total)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	// 没有认证的/check不能扫描
+	router.GET("/anonymous/check", checkHandler)
+	auth := func(c *gin.Context) {
+		c.Set(authUserId, uint(1))
+	}
+	router.GET("/check", auth, checkHandler)
+	router.GET("/check/jobs/:id", auth, checkJobHandler)
+	get := func(path string) map[string]interface{} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		var v map[string]interface{}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &v))
+		return v
+	}
+
+	// 扫描在后台进行，只保留有效的结果
+	v := get("/check?ip=127.0.0.0/30&port=80-81")
+	assert.Equal(t, float64(200), v["code"])
+	data := v["data"].(map[string]interface{})
+	assert.Equal(t, true, data["scan"])
+	assert.Equal(t, float64(8), data["total"])
+	id := data["id"].(string)
+	assert.Eventually(t, func() bool {
+		data = get("/check/jobs/" + id)["data"].(map[string]interface{})
+		return data["finished_at"] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, map[string]interface{}{checkStatusError: float64(8)}, data["counts"])
+	assert.Equal(t, float64(0), data["items"].(map[string]interface{})["total"])
+
+	assert.Equal(t, float64(400), get("/check?ip=1.1.1.1&port=80,x")["code"])
+	assert.Equal(t, float64(403), get("/anonymous/check?ip=127.0.0.0/30&port=80")["code"])
+
+	// 同时进行的任务数有上限，完成后可以继续提交
+	old := MaxCheckJobsPerUser
+	MaxCheckJobsPerUser = 1
+	t.Cleanup(func() {
+		MaxCheckJobsPerUser = old
+	})
+	running := newCheckJob(1, []string{"1.1.1.1:80"})
+	checkJobs.Set(running.id, running, CheckJobTTL)
+	assert.Equal(t, float64(429), get("/check?ip=127.0.0.0/30&port=80")["code"])
+	checkJobs.Delete(running.id)
+	assert.Equal(t, float64(200), get("/check?ip=127.0.0.0/30&port=80")["code"])
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/patrickmn/go-cache"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReuseCooldown 同一个出口ip访问同一个目标域名的冷却规则，在配置文件的cooldown节点下配置，两个条件都满足后才能再次使用
+type ReuseCooldown struct {
+	Interval time.Duration `mapstructure:"interval"` // 两次使用之间至少间隔的时间
+	Requests int           `mapstructure:"requests"` // 两次使用之间至少间隔的请求数，只统计这个用户对这个域名的请求
+}
+
+// enabled 是否开启了冷却
+func (rc ReuseCooldown) enabled() bool {
+	return rc.Interval > 0 || rc.Requests > 0
+}
+
+// hostUsage 用户对一个目标域名的使用记录
+type hostUsage struct {
+	seq int                // 请求的序号
+	ips map[string]ipUsage // 出口ip最后一次使用的情况
+}
+
+type ipUsage struct {
+	at  time.Time
+	seq int
+}
+
+var (
+	DefaultCooldown ReuseCooldown // 默认不开启
+
+	errCoolingDown = errors.New("all proxies are cooling down")
+
+	reuseLock  sync.Mutex
+	reuseUsage = cache.New(10*time.Minute, time.Minute) // 用户和目标域名对应的*hostUsage，长时间不访问的清理掉
+)
+
+func reuseKey(uid uint, host string) string {
+	return fmt.Sprintf("%d:%s", uid, strings.ToLower(host))
+}
+
+// outIPKey 没有检测出出口ip的代理按照代理id区分
+func outIPKey(p *models.Proxy) string {
+	if p.OutIP != "" {
+		return p.OutIP
+	}
+	return fmt.Sprintf("#%d", p.ID)
+}
+
+// isCooling 代理的出口ip是否还在这个域名的冷却期内
+func isCooling(uid uint, host string, p *models.Proxy, rc ReuseCooldown) bool {
+	if host == "" || !rc.enabled() {
+		return false
+	}
+
+	reuseLock.Lock()
+	defer reuseLock.Unlock()
+	v, found := reuseUsage.Get(reuseKey(uid, host))
+	if !found {
+		return false
+	}
+	hu := v.(*hostUsage)
+	last, ok := hu.ips[outIPKey(p)]
+	if !ok {
+		return false
+	}
+	if rc.Interval > 0 && time.Since(last.at) < rc.Interval {
+		return true
+	}
+	return rc.Requests > 0 && hu.seq-last.seq < rc.Requests
+}
+
+// markReuse 记录出口ip对这个域名的一次使用
+func markReuse(uid uint, host string, p *models.Proxy, rc ReuseCooldown) {
+	recordReuse(uid, host, p, rc, true)
+}
+
+// markReached 记录出口ip已经连接过这个域名，比如测试候选代理时建立了到目标的隧道但是没有被选中，不算一次请求
+func markReached(uid uint, host string, p *models.Proxy, rc ReuseCooldown) {
+	recordReuse(uid, host, p, rc, false)
+}
+
+// recordReuse 记录出口ip的使用，request表示是一次新的请求，请求序号加一
+func recordReuse(uid uint, host string, p *models.Proxy, rc ReuseCooldown, request bool) {
+	if host == "" || !rc.enabled() {
+		return
+	}
+
+	// 至少保留到冷却结束
+	ttl := 10 * time.Minute
+	if rc.Interval > ttl {
+		ttl = rc.Interval
+	}
+
+	reuseLock.Lock()
+	defer reuseLock.Unlock()
+	key := reuseKey(uid, host)
+	hu := &hostUsage{ips: map[string]ipUsage{}}
+	if v, found := reuseUsage.Get(key); found {
+		hu = v.(*hostUsage)
+	}
+	if request {
+		hu.seq++
+	}
+	hu.ips[outIPKey(p)] = ipUsage{at: time.Now(), seq: hu.seq}
+	// 清理已经冷却结束的记录，避免一直增长
+	for ip, u := range hu.ips {
+		if (rc.Interval <= 0 || time.Since(u.at) >= rc.Interval) && (rc.Requests <= 0 || hu.seq-u.seq >= rc.Requests) {
+			delete(hu.ips, ip)
+		}
+	}
+	reuseUsage.Set(key, hu, ttl)
+}
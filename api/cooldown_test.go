@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsCooling_requests(t *testing.T) {
+	defer reuseUsage.Flush()
+
+	rc := ReuseCooldown{Requests: 2}
+	newProxy := func(id uint, outIP string) *models.Proxy {
+		p := &models.Proxy{OutIP: outIP}
+		p.ID = id
+		return p
+	}
+	a := newProxy(1, "1.1.1.1")
+	b := newProxy(2, "2.2.2.2")
+	c := newProxy(3, "")
+
+	markReuse(1, "a.com", a, rc)
+	assert.True(t, isCooling(1, "a.com", a, rc))
+	assert.False(t, isCooling(1, "b.com", a, rc))
+	assert.False(t, isCooling(2, "a.com", a, rc))
+
+	// 中间隔了两个请求才能再次使用
+	markReuse(1, "a.com", b, rc)
+	assert.True(t, isCooling(1, "a.com", a, rc))
+	markReuse(1, "a.com", c, rc)
+	assert.False(t, isCooling(1, "a.com", a, rc))
+	assert.True(t, isCooling(1, "a.com", c, rc))
+
+	// 同一个出口ip的代理一起冷却
+	assert.True(t, isCooling(1, "a.com", newProxy(4, "2.2.2.2"), rc))
+	assert.False(t, isCooling(1, "a.com", a, ReuseCooldown{}))
+}
+
+func TestProxyServeHTTP_cooldown(t *testing.T) {
+	setupTestDB(t)
+
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", Cooldown: &ReuseCooldown{Interval: time.Minute}}})
+	t.Cleanup(func() {
+		SetUserSettings(nil)
+	})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	var ps []*models.Proxy
+	for _, outIP := range []string{"1.1.1.1", "2.2.2.2"} {
+		upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+		defer upstream.Close()
+		host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+		portNum, _ := strconv.Atoi(port)
+		ps = append(ps, &models.Proxy{IP: host, Port: portNum, ProxyType: "http", ProxyURL: upstream.URL,
+			Http: true, OutIP: outIP})
+	}
+	addTestUserProxy(t, "a@b.com", "1234", ps...)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	get := func(u string) (int, string) {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.Header.Set("X-Rproxy-Debug", "1")
+		resp, err := client.Do(req)
+		if !assert.Nil(t, err) {
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, resp.Header.Get("X-Rproxy-Out-IP")
+	}
+
+	// 两个出口ip各用一次
+	code, ip1 := get(target.URL)
+	assert.Equal(t, http.StatusOK, code)
+	code, ip2 := get(target.URL)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, ip1, ip2)
+
+	// 都在冷却期内
+	code, _ = get(target.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// 其他域名不受影响
+	code, _ = get(strings.Replace(target.URL, "127.0.0.1", "localhost", 1))
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestPickProxy_cooldownLosers(t *testing.T) {
+	setupTestDB(t)
+	defer reuseUsage.Flush()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	addr := target.Listener.Addr().String()
+
+	var ps []*models.Proxy
+	for _, outIP := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+		defer upstream.Close()
+		port := upstream.Listener.Addr().(*net.TCPAddr).Port
+		ps = append(ps, &models.Proxy{IP: "127.0.0.1", Port: port, ProxyType: "http", ProxyURL: upstream.URL,
+			Http: true, Connect: true, OutIP: outIP})
+	}
+	user := addTestUserProxy(t, "a@b.com", "1234", ps...)
+
+	// 三个候选代理都建立了到目标的隧道，没有被选中的也在冷却期内
+	opts := newProxyOptions()
+	opts.cooldown = ReuseCooldown{Interval: time.Minute}
+	p, conn, err := pickProxy(context.Background(), user.ID, true, opts, addr)
+	assert.Nil(t, err)
+	conn.Close()
+	assert.True(t, isCooling(user.ID, "127.0.0.1", p, opts.cooldown))
+	for _, lp := range ps {
+		lp := lp
+		assert.Eventually(t, func() bool {
+			return isCooling(user.ID, "127.0.0.1", lp, opts.cooldown)
+		}, time.Second, 10*time.Millisecond, lp.OutIP)
+	}
+
+	// 都在冷却期内
+	opts = newProxyOptions()
+	opts.cooldown = ReuseCooldown{Interval: time.Minute}
+	_, _, err = pickProxy(context.Background(), user.ID, true, opts, addr)
+	assert.Equal(t, errCoolingDown, err)
+}
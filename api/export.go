@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFormat 导出的格式
+type exportFormat struct {
+	ContentType string
+	Ext         string // 下载的文件扩展名
+	Write       func(buf *bytes.Buffer, ps []models.Proxy) error
+}
+
+var (
+	// exportFormats 支持的导出格式
+	exportFormats = map[string]exportFormat{
+		"txt":   {ContentType: "text/plain; charset=utf-8", Ext: "txt", Write: exportTxt},
+		"csv":   {ContentType: "text/csv; charset=utf-8", Ext: "csv", Write: exportCsv},
+		"jsonl": {ContentType: "application/x-ndjson", Ext: "jsonl", Write: exportJsonl},
+		"clash": {ContentType: "text/yaml; charset=utf-8", Ext: "yaml", Write: exportClash},
+		"pac":   {ContentType: "application/x-ns-proxy-autoconfig", Ext: "pac", Write: exportPac},
+		"curl":  {ContentType: "text/plain; charset=utf-8", Ext: "txt", Write: exportCurl},
+	}
+
+	// pacTypes 代理类型在pac中的写法，pac不支持认证信息
+	pacTypes = map[string]string{
+		"http":    "PROXY",
+		"https":   "HTTPS",
+		"socks4":  "SOCKS",
+		"socks4a": "SOCKS",
+		"socks5":  "SOCKS5",
+	}
+)
+
+// hostPort 代理的ip:port
+func hostPort(p *models.Proxy) string {
+	return net.JoinHostPort(p.IP, strconv.Itoa(p.Port))
+}
+
+// exportTxt 每行一个ip:port
+func exportTxt(buf *bytes.Buffer, ps []models.Proxy) error {
+	for i := range ps {
+		buf.WriteString(hostPort(&ps[i]) + "\n")
+	}
+	return nil
+}
+
+// exportCurl 每行一个完整的地址，可以直接用于curl -x
+func exportCurl(buf *bytes.Buffer, ps []models.Proxy) error {
+	for i := range ps {
+		u, err := proxyURLOf(&ps[i])
+		if err != nil {
+			continue
+		}
+		buf.WriteString(u.String() + "\n")
+	}
+	return nil
+}
+
+// exportCsv 带有表头，字段名跟导入的csv一致
+func exportCsv(buf *bytes.Buffer, ps []models.Proxy) error {
+	w := csv.NewWriter(buf)
+	w.Write([]string{"url", "type", "ip", "port", "out_ip", "country", "level", "latency", "https", "ipv6", "last_success_time"})
+	for i := range ps {
+		p := &ps[i]
+		lastSuccess := ""
+		if p.LastSuccessTime.Valid {
+			lastSuccess = p.LastSuccessTime.Time.Format(time.RFC3339)
+		}
+		u, err := proxyURLOf(p)
+		if err != nil {
+			continue
+		}
+		w.Write([]string{u.String(), strings.ToLower(p.ProxyType), p.IP, strconv.Itoa(p.Port), p.OutIP, p.Country,
+			p.ProxyLevel.String(), strconv.FormatInt(p.Latency, 10), strconv.FormatBool(p.Connect),
+			strconv.FormatBool(p.IPv6), lastSuccess})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// exportJsonl 每行一个代理的json
+func exportJsonl(buf *bytes.Buffer, ps []models.Proxy) error {
+	enc := json.NewEncoder(buf)
+	for i := range ps {
+		if err := enc.Encode(&ps[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportClash clash配置中的proxies和proxy-groups，clash只支持http和socks5
+func exportClash(buf *bytes.Buffer, ps []models.Proxy) error {
+	var proxies []map[string]interface{}
+	var names []string
+	for i := range ps {
+		u, err := proxyURLOf(&ps[i])
+		if err != nil {
+			continue
+		}
+		cp := map[string]interface{}{
+			"server": ps[i].IP,
+			"port":   ps[i].Port,
+		}
+		switch u.Scheme {
+		case "http":
+			cp["type"] = "http"
+		case "https":
+			cp["type"] = "http"
+			cp["tls"] = true
+			cp["skip-cert-verify"] = true
+		case "socks5":
+			cp["type"] = "socks5"
+		default:
+			continue
+		}
+		if u.User != nil {
+			cp["username"] = u.User.Username()
+			cp["password"], _ = u.User.Password()
+		}
+		cp["name"] = fmt.Sprintf("%s-%s", u.Scheme, hostPort(&ps[i]))
+		proxies = append(proxies, cp)
+		names = append(names, cp["name"].(string))
+	}
+
+	groups := []map[string]interface{}{}
+	if len(names) > 0 {
+		groups = append(groups, map[string]interface{}{
+			"name":     "rproxy",
+			"type":     "url-test",
+			"url":      "http://www.gstatic.com/generate_204",
+			"interval": 300,
+			"proxies":  names,
+		})
+	}
+	if proxies == nil {
+		proxies = []map[string]interface{}{}
+	}
+
+	enc := yaml.NewEncoder(buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]interface{}{
+		"proxies":      proxies,
+		"proxy-groups": groups,
+	}); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// exportPac 所有代理依次尝试，pac不支持认证信息
+func exportPac(buf *bytes.Buffer, ps []models.Proxy) error {
+	var list []string
+	for i := range ps {
+		if t, ok := pacTypes[strings.ToLower(ps[i].ProxyType)]; ok {
+			list = append(list, t+" "+hostPort(&ps[i]))
+		}
+	}
+	ret, _ := json.Marshal(strings.Join(list, "; "))
+	fmt.Fprintf(buf, "function FindProxyForURL(url, host) {\n  return %s;\n}\n", ret)
+	return nil
+}
+
+// isLive 最近一次检查或者使用是成功的
+func isLive(p *models.Proxy) bool {
+	return p.LastSuccessTime.Valid && (!p.LastFailedTime.Valid || !p.LastFailedTime.Time.After(p.LastSuccessTime.Time))
+}
+
+// exportProxies 用户的代理中符合条件的，all为false时只导出可用的，按照延迟排序
+func exportProxies(uid uint, filter proxyFilter, all bool, limit int) []models.Proxy {
+	now := time.Now()
+	ps := index.candidates(uid, func(p *models.Proxy) bool {
+		return (all || isLive(p)) && filter.match(p, now)
+	})
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Latency != ps[j].Latency {
+			return ps[i].Latency < ps[j].Latency
+		}
+		return ps[i].ID < ps[j].ID
+	})
+	if limit > 0 && len(ps) > limit {
+		ps = ps[:limit]
+	}
+	return ps
+}
+
+// exportHandler 导出当前用户的代理，format为txt/csv/jsonl/clash/pac/curl
+// 过滤条件通过filter参数或者X-Rproxy-Filter设置，跟代理请求一致，all=true时包括最近失败的代理，limit限制数量
+func exportHandler(c *gin.Context) {
+	format, ok := exportFormats[c.DefaultQuery("format", "txt")]
+	if !ok {
+		c.JSON(200, map[string]interface{}{
+			"code":    400,
+			"message": fmt.Sprintf("unknown format: %s", c.Query("format")),
+		})
+		return
+	}
+
+	filterStr := c.Query("filter")
+	if filterStr == "" {
+		filterStr = c.GetHeader("X-Rproxy-Filter")
+	}
+	filter, err := parseFilter(filterStr)
+	if err != nil {
+		c.JSON(200, map[string]interface{}{
+			"code":    400,
+			"message": fmt.Sprintf("invalid filter: %v", err),
+		})
+		return
+	}
+	all, _ := strconv.ParseBool(c.Query("all"))
+	limit, _ := strconv.Atoi(c.Query("limit"))
+
+	var buf bytes.Buffer
+	if err = format.Write(&buf, exportProxies(userId(c), filter, all, limit)); err != nil {
+		c.JSON(200, map[string]interface{}{
+			"code":    500,
+			"message": fmt.Sprintf("export failed: %v", err),
+		})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=rproxy.%s", format.Ext))
+	c.Data(http.StatusOK, format.ContentType, buf.Bytes())
+}
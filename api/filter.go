@@ -0,0 +1,287 @@
+package api
+
+import (
+	"fmt"
+	"github.com/LubyRuffy/rproxy/checkproxy"
+	"github.com/LubyRuffy/rproxy/models"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filterKind 过滤字段的值类型
+type filterKind int
+
+const (
+	filterString  filterKind = iota // 字符串
+	filterUpper                     // 字符串，不区分大小写，统一转为大写
+	filterInt                       // 整数
+	filterBool                      // true/false
+	filterLevel                     // 匿名级别，elite/anonymous/transparent或者数字
+	filterMinutes                   // 距离现在的分钟数
+	filterFloat                     // 小数
+)
+
+// filterField 过滤字段的定义
+type filterField struct {
+	Kind    filterKind                        // 值类型
+	EqualOp string                            // =对应的实际比较符，为空就是相等，比如latency=800等同于latency<=800
+	Value   func(p *models.Proxy) interface{} // 取出代理对应的值，nil表示没有值，任何条件都不满足
+}
+
+var (
+	// filterOps 支持的比较符，两个字符的要放前面
+	filterOps = []string{"<=", ">=", "!=", "<", ">", "="}
+
+	// filterFields X-Rproxy-Filter支持的字段
+	filterFields = map[string]filterField{
+		"type": {Kind: filterString, Value: func(p *models.Proxy) interface{} {
+			return strings.ToLower(p.ProxyType)
+		}},
+		"ip": {Kind: filterString, Value: func(p *models.Proxy) interface{} {
+			return p.IP
+		}},
+		"port": {Kind: filterInt, Value: func(p *models.Proxy) interface{} {
+			return p.Port
+		}},
+		"country": {Kind: filterUpper, Value: func(p *models.Proxy) interface{} {
+			return strings.ToUpper(p.Country)
+		}},
+		"level": {Kind: filterLevel, Value: func(p *models.Proxy) interface{} {
+			return int(p.ProxyLevel)
+		}},
+		"latency": {Kind: filterInt, EqualOp: "<=", Value: func(p *models.Proxy) interface{} {
+			return int(p.Latency)
+		}},
+		"ipv6": {Kind: filterBool, Value: func(p *models.Proxy) interface{} {
+			return p.IPv6
+		}},
+		"https": {Kind: filterBool, Value: func(p *models.Proxy) interface{} {
+			return p.Connect
+		}},
+		"checked": {Kind: filterMinutes, EqualOp: "<=", Value: func(p *models.Proxy) interface{} {
+			if !p.LastSuccessTime.Valid {
+				return nil
+			}
+			return p.LastSuccessTime.Time
+		}},
+		"rate": {Kind: filterFloat, EqualOp: ">=", Value: func(p *models.Proxy) interface{} {
+			if p.SuccessCount+p.FailedCount == 0 {
+				return nil
+			}
+			return float64(p.SuccessCount) / float64(p.SuccessCount+p.FailedCount)
+		}},
+	}
+)
+
+// filterCond 一个过滤条件，比如country=us,de或者latency<800
+type filterCond struct {
+	Key    string
+	Op     string
+	Values []interface{}
+}
+
+// proxyFilter 代理的过滤条件，条件之间是and的关系
+type proxyFilter []filterCond
+
+// parseFilterTerm 拆分一个过滤条件为key，比较符和值
+func parseFilterTerm(term string) (key, op, value string, err error) {
+	i := strings.IndexAny(term, "<>!=")
+	if i <= 0 {
+		return "", "", "", fmt.Errorf("invalid filter: %s", term)
+	}
+	for _, o := range filterOps {
+		if strings.HasPrefix(term[i:], o) {
+			op = o
+			break
+		}
+	}
+	if op == "" {
+		return "", "", "", fmt.Errorf("invalid filter: %s", term)
+	}
+
+	if key, err = url.QueryUnescape(strings.TrimSpace(term[:i])); err != nil {
+		return "", "", "", err
+	}
+	if value, err = url.QueryUnescape(strings.TrimSpace(term[i+len(op):])); err != nil {
+		return "", "", "", err
+	}
+	return strings.ToLower(key), op, value, nil
+}
+
+// newFilterCond 创建过滤条件，值可以是逗号分隔的多个，只有=和!=支持多个值
+func newFilterCond(key, op, value string) (filterCond, error) {
+	field, ok := filterFields[key]
+	if !ok {
+		return filterCond{}, fmt.Errorf("unknown filter key: %s", key)
+	}
+	if op == "=" && field.EqualOp != "" {
+		op = field.EqualOp
+	}
+
+	cond := filterCond{Key: key, Op: op}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		var val interface{}
+		var err error
+		switch field.Kind {
+		case filterString:
+			val = v
+			if key == "type" {
+				val = strings.ToLower(v)
+			}
+		case filterUpper:
+			val = strings.ToUpper(v)
+		case filterInt:
+			val, err = strconv.Atoi(v)
+		case filterBool:
+			val, err = strconv.ParseBool(v)
+		case filterLevel:
+			var level checkproxy.ProxyAnonymityLevel
+			level, err = checkproxy.ParseProxyAnonymityLevel(v)
+			val = int(level)
+		case filterMinutes:
+			var minutes float64
+			minutes, err = strconv.ParseFloat(v, 64)
+			val = time.Duration(minutes * float64(time.Minute))
+		case filterFloat:
+			val, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			return filterCond{}, fmt.Errorf("invalid filter value of %s: %s", key, v)
+		}
+		cond.Values = append(cond.Values, val)
+	}
+
+	if len(cond.Values) == 0 {
+		return filterCond{}, fmt.Errorf("empty filter value of %s", key)
+	}
+	if len(cond.Values) > 1 && op != "=" && op != "!=" {
+		return filterCond{}, fmt.Errorf("multiple values only support = and !=: %s", key)
+	}
+	if field.Kind == filterBool && op != "=" && op != "!=" {
+		return filterCond{}, fmt.Errorf("bool filter only support = and !=: %s", key)
+	}
+	return cond, nil
+}
+
+// parseFilter 解析过滤条件，多个条件用&分隔，比如：country=us,de&level=elite&latency<1000&checked<60&rate>=0.8
+func parseFilter(s string) (proxyFilter, error) {
+	var f proxyFilter
+	for _, term := range strings.Split(s, "&") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		key, op, value, err := parseFilterTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		cond, err := newFilterCond(key, op, value)
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, cond)
+	}
+	return f, nil
+}
+
+// has 是否已经有这个字段的过滤条件
+func (f proxyFilter) has(key string) bool {
+	for _, cond := range f {
+		if cond.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// compareFilterValue 比较两个同类型的值，返回-1，0，1
+func compareFilterValue(a, b interface{}) int {
+	switch av := a.(type) {
+	case int:
+		bv := b.(int)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+	case float64:
+		bv := b.(float64)
+		switch {
+		case av < bv:
+			return -1
+		case av > bv:
+			return 1
+		}
+	case string:
+		return strings.Compare(av, b.(string))
+	case bool:
+		if av != b.(bool) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// match 代理是否满足一个条件
+func (cond filterCond) match(p *models.Proxy, now time.Time) bool {
+	field := filterFields[cond.Key]
+	v := field.Value(p)
+
+	if field.Kind == filterMinutes {
+		// checked<60 表示最近60分钟内验证成功过，checked>60 表示最近60分钟都没有验证成功过
+		since := now.Add(-cond.Values[0].(time.Duration))
+		within := v != nil && !v.(time.Time).Before(since)
+		switch cond.Op {
+		case "<", "<=":
+			return within
+		default:
+			return !within
+		}
+	}
+
+	if v == nil {
+		return false
+	}
+
+	switch cond.Op {
+	case "=", "!=":
+		found := false
+		for _, cv := range cond.Values {
+			if compareFilterValue(v, cv) == 0 {
+				found = true
+				break
+			}
+		}
+		return found == (cond.Op == "=")
+	}
+
+	r := compareFilterValue(v, cond.Values[0])
+	switch cond.Op {
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	}
+	return false
+}
+
+// match 代理是否满足全部条件
+func (f proxyFilter) match(p *models.Proxy, now time.Time) bool {
+	for _, cond := range f {
+		if !cond.match(p, now) {
+			return false
+		}
+	}
+	return true
+}
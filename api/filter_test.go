@@ -0,0 +1,103 @@
+package api
+
+import (
+	"database/sql"
+	"github.com/LubyRuffy/rproxy/checkproxy"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := parseFilter("country=us,de&level=elite&latency<800&checked<=60&rate>=0.8&ipv6=false&type!=socks4")
+	assert.Nil(t, err)
+	assert.Equal(t, proxyFilter{
+		{Key: "country", Op: "=", Values: []interface{}{"US", "DE"}},
+		{Key: "level", Op: "=", Values: []interface{}{int(checkproxy.ProxyAnonymityElite)}},
+		{Key: "latency", Op: "<", Values: []interface{}{800}},
+		{Key: "checked", Op: "<=", Values: []interface{}{time.Hour}},
+		{Key: "rate", Op: ">=", Values: []interface{}{0.8}},
+		{Key: "ipv6", Op: "=", Values: []interface{}{false}},
+		{Key: "type", Op: "!=", Values: []interface{}{"socks4"}},
+	}, f)
+
+	// =在latency上表示最大值
+	f, err = parseFilter("latency=1000")
+	assert.Nil(t, err)
+	assert.Equal(t, "<=", f[0].Op)
+
+	// 兼容之前的格式
+	f, err = parseFilter("type=socks5&port=1080")
+	assert.Nil(t, err)
+	assert.Len(t, f, 2)
+
+	for _, s := range []string{
+		"abc=1",          // 不认识的key
+		"latency<abc",    // 值不对
+		"country",        // 没有比较符
+		"latency<1,2",    // 多个值只支持=和!=
+		"ipv6>true",      // bool只支持=和!=
+		"level=superman", // 匿名级别不对
+	} {
+		_, err = parseFilter(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestProxyFilter_match(t *testing.T) {
+	now := time.Now()
+	var ps []*models.Proxy
+	for _, info := range []struct {
+		country string
+		level   checkproxy.ProxyAnonymityLevel
+		latency int64
+		success int
+		failed  int
+		checked time.Time
+	}{
+		{"US", checkproxy.ProxyAnonymityElite, 500, 9, 1, now.Add(-10 * time.Minute)},
+		{"US", checkproxy.ProxyAnonymityTransparent, 500, 9, 1, now.Add(-10 * time.Minute)},
+		{"DE", checkproxy.ProxyAnonymityElite, 2000, 9, 1, now.Add(-10 * time.Minute)},
+		{"CN", checkproxy.ProxyAnonymityElite, 500, 1, 9, now.Add(-10 * time.Minute)},
+		{"us", checkproxy.ProxyAnonymityElite, 500, 9, 1, now.Add(-3 * time.Hour)},
+	} {
+		ps = append(ps, &models.Proxy{
+			ProxyType:       "http",
+			Country:         info.country,
+			ProxyLevel:      info.level,
+			Latency:         info.latency,
+			SuccessCount:    info.success,
+			FailedCount:     info.failed,
+			LastSuccessTime: sql.NullTime{Time: info.checked, Valid: true},
+		})
+	}
+
+	count := func(s string) int {
+		f, err := parseFilter(s)
+		assert.Nil(t, err)
+		n := 0
+		for _, p := range ps {
+			if f.match(p, now) {
+				n++
+			}
+		}
+		return n
+	}
+
+	assert.Equal(t, 5, count(""))
+	assert.Equal(t, 3, count("country=us"))
+	assert.Equal(t, 4, count("country=us,de"))
+	assert.Equal(t, 1, count("country!=us,de"))
+	assert.Equal(t, 4, count("level=elite"))
+	assert.Equal(t, 4, count("latency<1000"))
+	assert.Equal(t, 4, count("checked<60"))
+	assert.Equal(t, 1, count("checked>60"))
+	assert.Equal(t, 4, count("rate>=0.8"))
+	assert.Equal(t, 0, count("type=socks5"))
+	// 一个小时内验证成功过的，延迟1秒以内的美国高匿代理
+	assert.Equal(t, 1, count("country=us&level=elite&latency<1000&checked<60&rate>=0.8"))
+
+	// 没有验证过的代理不满足成功率的条件
+	assert.False(t, proxyFilter{{Key: "rate", Op: ">=", Values: []interface{}{0.0}}}.match(&models.Proxy{}, now))
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"sync"
+)
+
+// proxyIndex 内存中的代理索引，代理请求时只从这里选择代理，不用每次查询数据库
+// 代理的检查、添加和删除都要同步到索引
+type proxyIndex struct {
+	lock    sync.RWMutex
+	proxies map[uint]*models.Proxy     // 代理id对应的代理
+	users   map[uint]map[uint]struct{} // 用户id对应的代理id集合
+}
+
+var (
+	index = newProxyIndex() // 全局的代理索引
+)
+
+func newProxyIndex() *proxyIndex {
+	return &proxyIndex{
+		proxies: map[uint]*models.Proxy{},
+		users:   map[uint]map[uint]struct{}{},
+	}
+}
+
+// load 从数据库全量加载
+func (idx *proxyIndex) load() error {
+	var ps []models.Proxy
+	if err := models.GetDB().Find(&ps).Error; err != nil {
+		return err
+	}
+	var ups []models.UserProxy
+	if err := models.GetDB().Select("user_id", "proxy_id").Find(&ups).Error; err != nil {
+		return err
+	}
+
+	proxies := make(map[uint]*models.Proxy, len(ps))
+	for i := range ps {
+		proxies[ps[i].ID] = &ps[i]
+	}
+	users := map[uint]map[uint]struct{}{}
+	for _, up := range ups {
+		if _, ok := proxies[up.ProxyID]; !ok {
+			continue
+		}
+		if users[up.UserID] == nil {
+			users[up.UserID] = map[uint]struct{}{}
+		}
+		users[up.UserID][up.ProxyID] = struct{}{}
+	}
+
+	idx.lock.Lock()
+	idx.proxies = proxies
+	idx.users = users
+	idx.lock.Unlock()
+	return nil
+}
+
+// reload 从数据库重新加载一个代理
+func (idx *proxyIndex) reload(pid uint) error {
+	var p models.Proxy
+	if err := models.GetDB().Where("id=?", pid).Take(&p).Error; err != nil {
+		return err
+	}
+	idx.upsert(&p)
+	return nil
+}
+
+// upsert 添加或者更新代理，已经存在的代理保留内存中的统计数据，统计数据以stats的更新为准
+func (idx *proxyIndex) upsert(p *models.Proxy) {
+	np := *p
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if old, ok := idx.proxies[p.ID]; ok {
+		np.SuccessCount = old.SuccessCount
+		np.FailedCount = old.FailedCount
+		np.LastSuccessTime = old.LastSuccessTime
+		np.LastFailedTime = old.LastFailedTime
+		np.LastError = old.LastError
+	}
+	idx.proxies[p.ID] = &np
+}
+
+// addUserProxy 添加用户和代理的关系
+func (idx *proxyIndex) addUserProxy(uid, pid uint) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if idx.users[uid] == nil {
+		idx.users[uid] = map[uint]struct{}{}
+	}
+	idx.users[uid][pid] = struct{}{}
+}
+
+// removeUserProxy 删除用户和代理的关系
+func (idx *proxyIndex) removeUserProxy(uid, pid uint) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	delete(idx.users[uid], pid)
+}
+
+// get 获取用户的一个代理
+func (idx *proxyIndex) get(uid, pid uint) (models.Proxy, bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	if _, ok := idx.users[uid][pid]; !ok {
+		return models.Proxy{}, false
+	}
+	p, ok := idx.proxies[pid]
+	if !ok {
+		return models.Proxy{}, false
+	}
+	return *p, true
+}
+
+// update 修改代理，返回修改后的副本
+func (idx *proxyIndex) update(pid uint, f func(p *models.Proxy)) (models.Proxy, bool) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	p, ok := idx.proxies[pid]
+	if !ok {
+		return models.Proxy{}, false
+	}
+	f(p)
+	return *p, true
+}
+
+// candidates 用户的代理中符合条件的副本
+func (idx *proxyIndex) candidates(uid uint, match func(p *models.Proxy) bool) []models.Proxy {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	var ps []models.Proxy
+	for pid := range idx.users[uid] {
+		if p, ok := idx.proxies[pid]; ok && (match == nil || match(p)) {
+			ps = append(ps, *p)
+		}
+	}
+	return ps
+}
+
+// all 所有代理的副本
+func (idx *proxyIndex) all() []models.Proxy {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	ps := make([]models.Proxy, 0, len(idx.proxies))
+	for _, p := range idx.proxies {
+		ps = append(ps, *p)
+	}
+	return ps
+}
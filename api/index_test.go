@@ -0,0 +1,43 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestProxyIndex(t *testing.T) {
+	setupTestDB(t)
+
+	p1 := &models.Proxy{IP: "127.0.0.1", Port: 1, ProxyType: "http", ProxyURL: "http://127.0.0.1:1"}
+	p2 := &models.Proxy{IP: "127.0.0.1", Port: 2, ProxyType: "socks5", ProxyURL: "socks5://127.0.0.1:2", Connect: true}
+	user := addTestUserProxy(t, "a@b.com", "1234", p1, p2)
+	other := addTestUserProxy(t, "c@d.com", "1234", p2)
+
+	// 写库的同时同步到索引
+	assert.Len(t, index.candidates(user.ID, nil), 2)
+	assert.Len(t, index.candidates(other.ID, nil), 1)
+	assert.Len(t, index.candidates(user.ID, func(p *models.Proxy) bool {
+		return p.Connect
+	}), 1)
+	_, ok := index.get(other.ID, p1.ID)
+	assert.False(t, ok)
+
+	// 重新从数据库加载结果一致
+	idx := newProxyIndex()
+	assert.Nil(t, idx.load())
+	assert.Len(t, idx.candidates(user.ID, nil), 2)
+	assert.Len(t, idx.candidates(other.ID, nil), 1)
+
+	// 删除关系
+	index.removeUserProxy(user.ID, p2.ID)
+	assert.Len(t, index.candidates(user.ID, nil), 1)
+	assert.Len(t, index.candidates(other.ID, nil), 1)
+
+	// 修改返回的副本不影响索引
+	ps := index.candidates(user.ID, nil)
+	ps[0].Port = 100
+	p, ok := index.get(user.ID, p1.ID)
+	assert.True(t, ok)
+	assert.Equal(t, 1, p.Port)
+}
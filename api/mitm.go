@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/elazarl/goproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	MitmCACert = "ca.pem"     // mitm的CA证书，跟cert.pem放在一起，客户端需要信任这个证书
+	MitmCAKey  = "ca-key.pem" // mitm的CA私钥
+
+	mitmCAOnce sync.Once
+	mitmCACert *tls.Certificate
+	mitmCAErr  error
+	mitmCerts  = &certCache{cache.New(24*time.Hour, time.Hour)} // 签发的网站证书
+)
+
+// certCache 缓存签发的网站证书，避免每次CONNECT都重新生成
+type certCache struct {
+	c *cache.Cache
+}
+
+func (cc *certCache) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if v, found := cc.c.Get(hostname); found {
+		return v.(*tls.Certificate), nil
+	}
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	cc.c.SetDefault(hostname, cert)
+	return cert, nil
+}
+
+// generateCA 生成自签名的CA证书并且写入文件
+func generateCA(certFile, keyFile string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "rproxy CA", Organization: []string{"rproxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+}
+
+// mitmCA 加载mitm的CA，不存在就生成
+func mitmCA() (*tls.Certificate, error) {
+	mitmCAOnce.Do(func() {
+		if _, err := os.Stat(MitmCACert); os.IsNotExist(err) {
+			if mitmCAErr = generateCA(MitmCACert, MitmCAKey); mitmCAErr != nil {
+				return
+			}
+		}
+		var ca tls.Certificate
+		if ca, mitmCAErr = tls.LoadX509KeyPair(MitmCACert, MitmCAKey); mitmCAErr == nil {
+			mitmCACert = &ca
+		}
+	})
+	return mitmCACert, mitmCAErr
+}
+
+// inherit 没有设置的选项使用parent的，用于mitm中的请求继承CONNECT的选项
+func (opts *proxyOptions) inherit(parent *proxyOptions) {
+	if len(opts.Filter) == 0 {
+		opts.Filter = parent.Filter
+	}
+	if opts.Limit == defaultLimit {
+		opts.Limit = parent.Limit
+	}
+	if opts.Session == "" {
+		opts.Session = parent.Session
+	}
+	if opts.Strategy == "" {
+		opts.Strategy = parent.Strategy
+	}
+	if opts.Retries < 0 {
+		opts.Retries = parent.Retries
+	}
+	if opts.Route == "" {
+		opts.Route = parent.Route
+	}
+	if parent.Debug {
+		opts.Debug = true
+	}
+	opts.cooldown = parent.cooldown
+	opts.quota = parent.quota
+	opts.rate = parent.rate
+}
+
+// serveMitm 解密CONNECT的https流量，隧道中的每个请求都单独选择代理，过滤条件等选项跟CONNECT一致，请求中也可以带上X-Rproxy-*覆盖
+func serveMitm(c *gin.Context, uid uint, opts *proxyOptions) {
+	ca, err := mitmCA()
+	if err != nil {
+		c.Writer.WriteHeader(http.StatusInternalServerError)
+		c.Writer.Write([]byte("load mitm ca failed: " + err.Error()))
+		return
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = mitmCerts
+	proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(ca)}, host
+	}))
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		reqOpts, err := headerProxyOptions(req.Header)
+		if err != nil {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadRequest, err.Error())
+		}
+		reqOpts.inherit(opts)
+		if !canRetry(req) {
+			reqOpts.noResend = true
+		}
+
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			if ok, wait := allowRate(rateScopeProxy, strconv.FormatUint(uint64(uid), 10), reqOpts.rate); !ok {
+				finishAccessLog(accessLogOf(uid, req.Method, targetAddr(req.URL)), http.StatusTooManyRequests, nil, errRateLimited)
+				return rateLimitHTTPResponse(req, wait), nil
+			}
+			release, err := usage.begin(uid, reqOpts.quota)
+			if err != nil {
+				finishAccessLog(accessLogOf(uid, req.Method, targetAddr(req.URL)), http.StatusTooManyRequests, nil, err)
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, err.Error()), nil
+			}
+			resp, err := roundTripByProxy(req, uid, reqOpts, nil, nil)
+			if err != nil {
+				release()
+			} else {
+				// 响应内容转发完成后释放连接
+				resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+			}
+			switch err {
+			case errNoAliveProxy:
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, err.Error()), nil
+			case errCoolingDown:
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, err.Error()), nil
+			}
+			return resp, err
+		})
+		return req, nil
+	})
+
+	// 解密后的连接在goproxy的后台goroutine中处理，登记后停止服务时可以关闭
+	proxy.ServeHTTP(&trackedWriter{ResponseWriter: c.Writer}, c.Request)
+}
+
+// trackedWriter hijack出来的连接登记到relays
+type trackedWriter struct {
+	gin.ResponseWriter
+}
+
+func (w *trackedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &trackedConn{Conn: conn}
+	tc.done = relays.add(0, func() { conn.Close() })
+	return tc, rw, nil
+}
+
+// trackedConn 处理连接的goroutine关闭连接时才算结束，这时响应内容都已经关闭
+type trackedConn struct {
+	net.Conn
+	once sync.Once
+	done func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.done)
+	return err
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeMitm(t *testing.T) {
+	setupTestDB(t)
+
+	dir := t.TempDir()
+	MitmCACert = filepath.Join(dir, "ca.pem")
+	MitmCAKey = filepath.Join(dir, "ca-key.pem")
+	mitmCAOnce = sync.Once{}
+	mitmCerts.c.Flush()
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", Mitm: true}})
+	t.Cleanup(func() {
+		SetUserSettings(nil)
+	})
+
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	// 两个上游，记录各自收到的CONNECT
+	var counts [2]int32
+	var ps []*models.Proxy
+	for i := range counts {
+		i := i
+		gp := goproxy.NewProxyHttpServer()
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&counts[i], 1)
+			gp.ServeHTTP(w, r)
+		}))
+		defer upstream.Close()
+		host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+		portNum, _ := strconv.Atoi(port)
+		ps = append(ps, &models.Proxy{IP: host, Port: portNum, ProxyType: "http", ProxyURL: upstream.URL,
+			Http: true, Connect: true})
+	}
+	addTestUserProxy(t, "a@b.com", "1234", ps...)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	// 客户端信任生成的CA
+	ca, err := mitmCA()
+	assert.Nil(t, err)
+	_, err = os.Stat(MitmCACert)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(ca.Certificate[0])
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	header := http.Header{}
+	header.Set("X-Rproxy-Strategy", "roundrobin")
+	header.Set("X-Rproxy-Limit", "1")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(proxyUrl),
+		ProxyConnectHeader: header,
+		TLSClientConfig:    &tls.Config{RootCAs: pool},
+	}}
+	// 目标网站的证书不可信时请求失败，不会把解密的流量发给上游
+	resp, err := client.Get(target.URL)
+	if err == nil {
+		assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	atomic.StoreInt32(&counts[0], 0)
+	atomic.StoreInt32(&counts[1], 0)
+
+	targetRootCAs = x509.NewCertPool()
+	targetRootCAs.AddCert(target.Certificate())
+	t.Cleanup(func() { targetRootCAs = nil })
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(target.URL)
+		if !assert.Nil(t, err) {
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+	}
+
+	// 每个请求轮流使用不同的上游
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counts[0]))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&counts[1]))
+}
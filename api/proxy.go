@@ -1,144 +1,638 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/LubyRuffy/rproxy/models"
 	"github.com/elazarl/goproxy"
 	"github.com/gin-gonic/gin"
-	"h12.io/socks"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	defaultTimeOut = time.Second * 15
+	defaultLimit   = 3 // 每次取三条测试
+
+	errNoAliveProxy = errors.New("no alive proxy")
+
+	// targetRootCAs 验证https目标证书的根证书，nil表示使用系统的，测试时可以替换
+	targetRootCAs *x509.CertPool
+
+	// optionKeys 过滤条件之外的选项，可以在用户名和socks5的query中设置
+	optionKeys = map[string]bool{
+		"limit":    true,
+		"session":  true,
+		"strategy": true,
+		"retries":  true,
+		"debug":    true,
+		"route":    true,
+	}
 )
 
-func proxyServeHTTP(c *gin.Context) {
-	// 外部做好认证
+// proxyOptions 代理请求的选项，http请求来自header，socks5请求来自用户名
+type proxyOptions struct {
+	Filter   proxyFilter // 过滤条件，同X-Rproxy-Filter
+	Limit    int         // 每次测试的代理个数，同X-Rproxy-Limit
+	Session  string      // 会话id，同一个会话固定使用一个代理，同X-Rproxy-Session
+	Strategy string      // 代理选择策略，同X-Rproxy-Strategy
+	Retries  int         // 上游失败后换代理重试的次数，同X-Rproxy-Retries，-1表示使用默认值
+	Debug    bool        // 响应中返回使用的上游代理信息，同X-Rproxy-Debug
+	Route    string      // 多跳的路由名称，同X-Rproxy-Route
 
-	db := models.GetDB().Model(&models.Proxy{}).
-		Joins("join user_proxies on user_proxies.proxy_id=proxies.id").
-		Where("user_proxies.proxy_id>0 and user_proxies.user_id=?", userId(c))
-	proxy := goproxy.NewProxyHttpServer()
+	cooldown ReuseCooldown     // 出口ip访问同一个域名的冷却规则，来自用户的配置
+	quota    UserQuota         // 用户的配额，来自用户的配置
+	rate     RateLimit         // 代理请求的限速，来自用户的配置
+	excluded map[uint]struct{} // 本次请求已经失败的代理，重试时不再选择
+	failures int               // 本次请求已经重新发送的次数
+	redials  int               // 本次请求握手都失败后换一批代理的次数
+	noResend bool              // 请求不能重新发送，只在握手失败时换代理
+}
+
+func newProxyOptions() *proxyOptions {
+	return &proxyOptions{Limit: defaultLimit, Retries: -1}
+}
+
+// headerProxyOptions 从header中提取代理选项，提取后删除对应的header，不转发给上游
+func headerProxyOptions(h http.Header) (*proxyOptions, error) {
+	opts := newProxyOptions()
+
+	if filter := h.Get("X-Rproxy-Filter"); len(filter) > 0 {
+		f, err := parseFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		opts.Filter = f
+		h.Del("X-Rproxy-Filter")
+	}
+
+	if v := h.Get("X-Rproxy-Limit"); len(v) > 0 {
+		if vl, err := strconv.Atoi(v); err == nil && vl > 0 {
+			opts.Limit = vl
+		}
+		h.Del("X-Rproxy-Limit")
+	}
+
+	if v := h.Get("X-Rproxy-Session"); len(v) > 0 {
+		opts.Session = v
+		h.Del("X-Rproxy-Session")
+	}
 
-	if c.Request.Method == http.MethodConnect {
-		db = db.Where(&models.Proxy{Connect: true})
+	if v := h.Get("X-Rproxy-Strategy"); len(v) > 0 {
+		if _, ok := Strategies[v]; !ok {
+			return nil, fmt.Errorf("unknown strategy: %s", v)
+		}
+		opts.Strategy = v
+		h.Del("X-Rproxy-Strategy")
+	}
+
+	if v := h.Get("X-Rproxy-Retries"); len(v) > 0 {
+		if vr, err := strconv.Atoi(v); err == nil && vr >= 0 {
+			opts.Retries = vr
+		}
+		h.Del("X-Rproxy-Retries")
+	}
+
+	if v := h.Get("X-Rproxy-Debug"); len(v) > 0 {
+		opts.Debug, _ = strconv.ParseBool(v)
+		h.Del("X-Rproxy-Debug")
 	}
 
-	if filter := c.Request.Header.Get("X-Rproxy-Filter"); len(filter) > 0 {
-		v, err := url.ParseQuery(filter)
+	if v := h.Get("X-Rproxy-Route"); len(v) > 0 {
+		if _, err := routeByName(v); err != nil {
+			return nil, err
+		}
+		opts.Route = v
+		h.Del("X-Rproxy-Route")
+	}
+
+	return opts, nil
+}
+
+// queryProxyOptions 从query格式的字符串中提取代理选项，如：type=socks5&latency<1000&limit=1&session=abc
+func queryProxyOptions(query string) (*proxyOptions, error) {
+	opts := newProxyOptions()
+	v := url.Values{}
+	for _, term := range strings.Split(query, "&") {
+		if strings.TrimSpace(term) == "" {
+			continue
+		}
+		key, op, value, err := parseFilterTerm(term)
 		if err != nil {
-			c.Writer.WriteHeader(http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		for k, vs := range v {
-			switch k {
-			case "type":
-				db = db.Where(&models.Proxy{ProxyType: vs[0]})
-			case "ip":
-				db = db.Where(&models.Proxy{IP: vs[0]})
-			case "port":
-				if v, err := strconv.Atoi(vs[0]); err == nil {
-					db = db.Where(&models.Proxy{Port: v})
-				}
+		if op == "=" && optionKeys[key] {
+			v.Set(key, value)
+			continue
+		}
+		cond, err := newFilterCond(key, op, value)
+		if err != nil {
+			return nil, err
+		}
+		opts.Filter = append(opts.Filter, cond)
+	}
+
+	if err := opts.merge(v); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// merge 合并key=value格式的选项，optionKeys之外的都是过滤条件，已经设置过的选项不会被覆盖
+func (opts *proxyOptions) merge(v url.Values) error {
+	for k, vs := range v {
+		if len(vs) == 0 {
+			continue
+		}
+		switch k {
+		case "limit":
+			if vl, err := strconv.Atoi(vs[0]); err == nil && vl > 0 && opts.Limit == defaultLimit {
+				opts.Limit = vl
+			}
+		case "session":
+			if opts.Session == "" {
+				opts.Session = vs[0]
+			}
+		case "strategy":
+			if _, ok := Strategies[vs[0]]; !ok {
+				return fmt.Errorf("unknown strategy: %s", vs[0])
+			}
+			if opts.Strategy == "" {
+				opts.Strategy = vs[0]
+			}
+		case "retries":
+			if vr, err := strconv.Atoi(vs[0]); err == nil && vr >= 0 && opts.Retries < 0 {
+				opts.Retries = vr
 			}
+		case "debug":
+			if debug, err := strconv.ParseBool(vs[0]); err == nil && debug {
+				opts.Debug = true
+			}
+		case "route":
+			if _, err := routeByName(vs[0]); err != nil {
+				return err
+			}
+			if opts.Route == "" {
+				opts.Route = vs[0]
+			}
+		default:
+			if opts.Filter.has(k) {
+				continue
+			}
+			cond, err := newFilterCond(k, "=", strings.Join(vs, ","))
+			if err != nil {
+				return err
+			}
+			opts.Filter = append(opts.Filter, cond)
 		}
-		c.Request.Header.Del("X-Rproxy-Filter")
 	}
+	return nil
+}
 
-	// 每次取三条测试
-	var ps []models.Proxy
-	limit := 3 // default limit is 3
-	if v := c.Request.Header.Get("X-Rproxy-Limit"); len(v) > 0 {
-		if vl, err := strconv.Atoi(v); err == nil && vl > 0 {
-			limit = vl
+// complete 合并用户名中的选项，没有设置的选项使用用户的配置
+func (opts *proxyOptions) complete(c *gin.Context) error {
+	if err := opts.merge(authOptions(c)); err != nil {
+		return err
+	}
+	setting := userSetting(c.GetString(authUserKey))
+	if opts.Strategy == "" {
+		opts.Strategy = setting.Strategy
+	}
+	if opts.Route == "" {
+		opts.Route = setting.Route
+		if _, err := routeByName(opts.Route); err != nil {
+			return err
 		}
-		c.Request.Header.Del("X-Rproxy-Limit")
 	}
+	if setting.Debug {
+		opts.Debug = true
+	}
+	opts.cooldown = *setting.Cooldown
+	opts.quota = *setting.Quota
+	opts.rate = setting.RateLimit.Proxy
+	if opts.Retries < 0 {
+		opts.Retries = DefaultRetries
+	}
+	return nil
+}
 
-	if err := db.Order("RANDOM()").Limit(limit).Find(&ps).Error; err != nil || len(ps) == 0 {
-		c.Writer.WriteHeader(http.StatusInternalServerError)
-		c.Writer.Write([]byte("no alive proxy"))
-		return
+// retry 请求失败后是否还可以换代理重新发送，可以的话占用一次重试次数
+func (opts *proxyOptions) retry() bool {
+	if opts.noResend || opts.failures >= opts.Retries {
+		return false
 	}
+	opts.failures++
+	return true
+}
 
-	// 尝试连接
-	ch := make(chan *models.Proxy, 1)
-	hasSign := false
-	var signLock sync.Mutex
-	for _, p := range ps {
-		go func(p models.Proxy) {
-			log.Printf("fetch %s from %s", c.Request.RequestURI, p.ProxyURL)
+// redial 握手都失败后是否还可以换一批代理，这时请求还没有发送，所有请求都可以，跟retry分开计数
+func (opts *proxyOptions) redial() bool {
+	if opts.redials >= opts.Retries {
+		return false
+	}
+	opts.redials++
+	return true
+}
 
-			var conn net.Conn
-			var err error
+// exclude 本次请求不再选择这个代理
+func (opts *proxyOptions) exclude(pid uint) {
+	if opts.excluded == nil {
+		opts.excluded = map[uint]struct{}{}
+	}
+	opts.excluded[pid] = struct{}{}
+}
 
-			conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", p.IP, p.Port))
+// selectProxies 从用户的代理中根据条件和选择策略取出候选代理，host为目标域名，跳过被这个域名封禁以及还在冷却期内的代理
+// 符合条件的代理都在冷却期内时返回errCoolingDown
+func selectProxies(uid uint, connect bool, opts *proxyOptions, host string) ([]models.Proxy, error) {
+	strategy, ok := Strategies[opts.Strategy]
+	if !ok {
+		strategy = Strategies[DefaultStrategy]
+	}
 
+	now := time.Now()
+	cooling := 0
+	ps := index.candidates(uid, func(p *models.Proxy) bool {
+		if _, ok := opts.excluded[p.ID]; ok || isBanned(p.ID, host) {
+			return false
+		}
+		if !(!connect || p.Connect) || !opts.Filter.match(p, now) {
+			return false
+		}
+		if isCooling(uid, host, p, opts.cooldown) {
+			cooling++
+			return false
+		}
+		return true
+	})
+	ps = strategy(uid, ps, opts.Limit)
+	if len(ps) == 0 {
+		if cooling > 0 {
+			return nil, errCoolingDown
+		}
+		return nil, errNoAliveProxy
+	}
+	return ps, nil
+}
+
+// fastestProxy 并发对候选代理进行协议握手，返回最先成功的一个以及握手后的连接，都失败或者超时返回nil
+// addr是请求的目标地址，握手建立的隧道可以直接用于请求，其他成功的连接会被关闭，route不为空时经过路由中的其他代理
+// reached不为nil时，每个建立了到目标的隧道的代理都会调用，包括没有被选中的
+func fastestProxy(ctx context.Context, ps []models.Proxy, route *Route, addr string, connect bool,
+	reached func(p *models.Proxy)) (*models.Proxy, *upstreamConn) {
+	type dialResult struct {
+		p    models.Proxy
+		conn *upstreamConn
+	}
+
+	ch := make(chan dialResult, len(ps))
+	var wg sync.WaitGroup
+	for _, p := range ps {
+		wg.Add(1)
+		go func(p models.Proxy) {
+			defer wg.Done()
+
+			start := time.Now()
+			conn, err := dialUpstream(ctx, &p, route, addr, connect)
 			if err != nil {
-				p.FailedCount++
-				p.LastFailedTime.Time = time.Now()
-				p.LastFailedTime.Valid = true
-				p.LastError = err.Error()
-				models.GetDB().Save(&p)
+				if ctx.Err() == nil {
+					stats.record(p.ID, err, 0)
+				}
 				return
 			}
+			if conn.Tunnel && reached != nil {
+				// 目标已经看到了这个出口ip的连接
+				reached(&p)
+			}
 
-			defer conn.Close()
+			ch <- dialResult{p: p, conn: conn}
 
-			if !hasSign {
-				signLock.Lock()
-				hasSign = true
-				signLock.Unlock()
-				ch <- &p
+			// 只有完成握手的才记录延迟
+			var latency time.Duration
+			if conn.Tunnel {
+				latency = time.Since(start)
 			}
-
-			p.SuccessCount++
-			p.LastSuccessTime.Time = time.Now()
-			p.LastSuccessTime.Valid = true
-			models.GetDB().Save(&p)
+			stats.record(p.ID, nil, latency)
 		}(p)
 	}
+	// 全部失败的情况下不用等到超时
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	// 关闭没有被选中的连接
+	closeRest := func() {
+		for r := range ch {
+			r.conn.Close()
+		}
+	}
 
+	timer := time.NewTimer(defaultTimeOut)
+	defer timer.Stop()
 	select {
-	case <-c.Request.Context().Done():
+	case <-ctx.Done():
+	case r, ok := <-ch:
+		if ok {
+			go closeRest()
+			return &r.p, r.conn
+		}
+	case <-timer.C:
+	}
+	go closeRest()
+	return nil, nil
+}
+
+// pickProxy 选择一个可用的代理，有会话的情况下优先使用会话绑定的代理，绑定的代理不可用时重新选择并绑定
+// 返回代理以及握手后的连接，addr是请求的目标地址
+func pickProxy(ctx context.Context, uid uint, connect bool, opts *proxyOptions, addr string) (*models.Proxy, *upstreamConn, error) {
+	host := hostOfAddr(addr)
+	route, err := routeByName(opts.Route)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 没有被选中的代理如果已经连接到了目标，同样要冷却
+	reached := func(p *models.Proxy) {
+		markReached(uid, host, p, opts.cooldown)
+	}
+	if sp := sessionProxy(uid, connect, opts, host); sp != nil {
+		// 会话保持的代理不受冷却限制
+		if p, conn := fastestProxy(ctx, []models.Proxy{*sp}, route, addr, connect, reached); p != nil {
+			pinSession(uid, opts.Session, p)
+			markUsed(p)
+			markReuse(uid, host, p, opts.cooldown)
+			return p, conn, nil
+		}
+		log.Printf("session %s of proxy %s failed, select another one", opts.Session, sp.ProxyURL)
+		unpinSession(uid, opts.Session)
+		opts.exclude(sp.ID)
+	}
+
+	for {
+		ps, err := selectProxies(uid, connect, opts, host)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// 尝试握手
+		if p, conn := fastestProxy(ctx, ps, route, addr, connect, reached); p != nil {
+			pinSession(uid, opts.Session, p)
+			markUsed(p)
+			markReuse(uid, host, p, opts.cooldown)
+			return p, conn, nil
+		}
+		if ctx.Err() != nil || !opts.redial() {
+			return nil, nil, errNoAliveProxy
+		}
+		// 这一批都握手失败了，换一批
+		for _, p := range ps {
+			opts.exclude(p.ID)
+		}
+	}
+}
+
+// targetAddr 请求的目标地址，没有端口的按照协议补全
+func targetAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+func proxyServeHTTP(c *gin.Context) {
+	// 外部做好认证
+
+	opts, err := headerProxyOptions(c.Request.Header)
+	if err == nil {
+		// 用户名中的选项以及用户的配置，header优先
+		err = opts.complete(c)
+	}
+	if err != nil {
+		c.Writer.WriteHeader(http.StatusBadRequest)
+		c.Writer.Write([]byte(err.Error()))
+		return
+	}
+
+	uid := userId(c)
+	if ok, wait := allowRate(rateScopeProxy, rateLimitKey(c), opts.rate); !ok {
+		finishAccessLog(accessLogOf(uid, c.Request.Method, c.Request.Host), http.StatusTooManyRequests, nil, errRateLimited)
+		rateLimitResponse(c, wait)
+		return
+	}
+	connect := c.Request.Method == http.MethodConnect
+	if connect && userSetting(c.GetString(authUserKey)).Mitm {
+		// 隧道中的每个请求单独选择代理，单独计算连接数
+		if err = usage.check(uid, opts.quota); err != nil {
+			c.Writer.WriteHeader(http.StatusTooManyRequests)
+			c.Writer.Write([]byte(err.Error()))
+			return
+		}
+		serveMitm(c, uid, opts)
+		return
+	}
+	ctx := c.Request.Context()
+	addr := c.Request.Host
+	if !connect {
+		addr = targetAddr(c.Request.URL)
+	}
+	if !canRetry(c.Request) {
+		opts.noResend = true
+	}
+	al := accessLogOf(uid, c.Request.Method, addr)
+	release, err := usage.begin(uid, opts.quota)
+	if err != nil {
+		finishAccessLog(al, http.StatusTooManyRequests, nil, err)
+		c.Writer.WriteHeader(http.StatusTooManyRequests)
+		c.Writer.Write([]byte(err.Error()))
+		return
+	}
+	if !connect {
+		// 普通请求在返回时已经转发完成，隧道在关闭时释放
+		defer release()
+	}
+	p, conn, err := pickProxy(ctx, uid, connect, opts, addr)
+	if err != nil {
+		release()
+		if ctx.Err() != nil {
+			finishAccessLog(al, 0, nil, ctx.Err())
+			return
+		}
+		finishAccessLog(al, errorStatus(err), nil, err)
+		if err == errCoolingDown {
+			c.Writer.WriteHeader(http.StatusServiceUnavailable)
+			c.Writer.Write([]byte(err.Error()))
+			return
+		}
+		c.Writer.WriteHeader(http.StatusInternalServerError)
+		c.Writer.Write([]byte(errNoAliveProxy.Error()))
 		return
-	case p := <-ch:
-		if c.Request.Method == http.MethodConnect {
-			proxy.ConnectDial = proxy.NewConnectDialToProxy(p.ProxyURL)
-		} else {
-			if p.ProxyType == "socks4" {
-				// 需要支持吗？
-				proxy.Tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return socks.Dial(p.ProxyURL)(network, addr)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	if connect {
+		// 隧道关闭时记录收发的字节数
+		tunnel := &countingConn{Conn: conn, counter: usageCounter{uid: uid}, onClose: func(in, out int64) {
+			release()
+			al.BytesIn, al.BytesOut = in, out
+			finishAccessLog(al, http.StatusOK, p, nil)
+		}}
+		// 选择代理时已经完成握手，失败的会换代理重试，这里直接使用建立好的隧道
+		// 自己处理CONNECT，debug时在200的响应中带上上游代理信息，任意一端关闭后关闭整个隧道，及时释放连接
+		proxy.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+			return &goproxy.ConnectAction{Action: goproxy.ConnectHijack, Hijack: func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+				log.Printf("fetch %s from %s", host, p.ProxyURL)
+				var buf bytes.Buffer
+				buf.WriteString("HTTP/1.0 200 Connection established\r\n")
+				if opts.Debug {
+					upstreamHeaders(p, opts).Write(&buf)
 				}
-			} else {
-				proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
-					return url.Parse(p.ProxyURL)
+				buf.WriteString("\r\n")
+				if _, err := client.Write(buf.Bytes()); err != nil {
+					client.Close()
+					tunnel.Close()
+					return
 				}
-				proxy.Tr.IdleConnTimeout = time.Second * 10
+				relay(p.ID, client, tunnel)
+			}}, host
+		}))
+	} else {
+		proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, pctx *goproxy.ProxyCtx) (*http.Response, error) {
+				return roundTripByProxy(req, uid, opts, p, conn)
+			})
+			return req, nil
+		})
+	}
+
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// roundTripByProxy 通过代理发送http请求，失败的时候换代理重试
+// p和conn是已经选好的代理和握手后的连接，为nil时重新选择，https请求需要支持CONNECT的代理
+func roundTripByProxy(req *http.Request, uid uint, opts *proxyOptions, p *models.Proxy, conn *upstreamConn) (*http.Response, error) {
+	connect := req.URL.Scheme == "https"
+	addr := targetAddr(req.URL)
+	al := accessLogOf(uid, req.Method, addr)
+	if p == nil {
+		var err error
+		if p, conn, err = pickProxy(req.Context(), uid, connect, opts, addr); err != nil {
+			finishAccessLog(al, errorStatus(err), nil, err)
+			return nil, err
+		}
+	}
+
+	rules := currentBanRules()
+	var resp *http.Response
+	p, err := tryProxies(req.Context(), uid, connect, opts, addr, p, conn, func(p *models.Proxy, conn *upstreamConn) error {
+		if resp != nil {
+			// 上一个代理被封禁了，换代理重试
+			resp.Body.Close()
+			resp = nil
+		}
+
+		log.Printf("fetch %s from %s", req.URL, p.ProxyURL)
+		var err error
+		resp, err = proxyTransport(p, conn, req.URL.Hostname()).RoundTrip(req)
+		if err != nil {
+			if rules.Reset && isConnReset(err) {
+				banProxy(p.ID, p.ProxyURL, req.URL.Hostname(), "connection reset")
 			}
+			return err
 		}
+		if reason := rules.check(resp); reason != "" {
+			banProxy(p.ID, p.ProxyURL, req.URL.Hostname(), reason)
+			return errBanned
+		}
+		return nil
+	})
+	if err == errBanned {
+		// 没有重试的机会了，返回目标网站的响应
+		err = nil
+	}
+	if err != nil {
+		finishAccessLog(al, http.StatusInternalServerError, p, err)
+		return nil, err
+	}
+	if opts.Debug {
+		for k, v := range upstreamHeaders(p, opts) {
+			resp.Header[k] = v
+		}
+	}
 
+	// 响应内容转发完成后记录
+	if req.ContentLength > 0 {
+		al.BytesOut = req.ContentLength
+		usage.addBytes(uid, req.ContentLength)
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, counter: usageCounter{uid: uid}, onClose: func(n int64) {
+		al.BytesIn = n
+		finishAccessLog(al, resp.StatusCode, p, nil)
+	}}
+	return resp, nil
+}
+
+// upstreamHeaders 返回给客户端的上游代理信息，用于排查问题
+func upstreamHeaders(p *models.Proxy, opts *proxyOptions) http.Header {
+	h := http.Header{}
+	upstream := p.ProxyURL
+	if u, err := url.Parse(p.ProxyURL); err == nil {
+		// 不能泄露上游的账号
+		u.User = nil
+		upstream = u.String()
+	}
+	h.Set("X-Rproxy-Upstream", fmt.Sprintf("%d %s", p.ID, upstream))
+	if p.OutIP != "" {
+		h.Set("X-Rproxy-Out-IP", p.OutIP)
+	}
+	if opts.Route != "" {
+		h.Set("X-Rproxy-Route", opts.Route)
+	}
+	if p.Country != "" {
+		h.Set("X-Rproxy-Country", p.Country)
+	}
+	h.Set("X-Rproxy-Attempts", strconv.Itoa(opts.failures+1))
+	return h
+}
+
+// proxyTransport 通过代理p发送http请求的transport，第一次连接使用握手后的conn
+// https的目标要验证证书，上游代理是不可信的，不能让它拿到解密后的流量
+func proxyTransport(p *models.Proxy, conn *upstreamConn, serverName string) *http.Transport {
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: serverName, RootCAs: targetRootCAs},
+		// 每次请求一个transport，不保持连接
+		DisableKeepAlives: true,
 		// 设置超时机制
-		if proxy.Tr != nil {
-			proxy.Tr.TLSHandshakeTimeout = defaultTimeOut
-			proxy.Tr.ResponseHeaderTimeout = defaultTimeOut
-			proxy.Tr.IdleConnTimeout = defaultTimeOut
-			proxy.Tr.ExpectContinueTimeout = defaultTimeOut
-		}
-	case <-time.After(defaultTimeOut):
-		c.Writer.WriteHeader(http.StatusInternalServerError)
-		c.Writer.Write([]byte("no alive proxy"))
-		return
+		TLSHandshakeTimeout:   defaultTimeOut,
+		ResponseHeaderTimeout: defaultTimeOut,
+		IdleConnTimeout:       defaultTimeOut,
+		ExpectContinueTimeout: defaultTimeOut,
+	}
+	if !conn.Tunnel {
+		// 只连接到了http代理，发送代理格式的请求；https代理的tls已经在连接上完成，按照http代理发送
+		u := *conn.Proxy
+		u.Scheme = "http"
+		tr.Proxy = http.ProxyURL(&u)
 	}
 
-	proxy.ServeHTTP(c.Writer, c.Request)
+	var reused int32
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.CompareAndSwapInt32(&reused, 0, 1) {
+			return conn, nil
+		}
+		return dialChain(ctx, conn.hops, addr, false)
+	}
+	return tr
 }
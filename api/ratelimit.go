@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elazarl/goproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit 令牌桶限速，Rate为每秒的请求数，Burst为允许的突发请求数，Rate为0表示不限制
+type RateLimit struct {
+	Rate  float64 `mapstructure:"rate"`
+	Burst int     `mapstructure:"burst"`
+}
+
+// RateLimits 用户的限速，在配置文件的ratelimit节点下配置，users下可以单独覆盖
+type RateLimits struct {
+	Proxy RateLimit `mapstructure:"proxy"` // 代理请求，包括http/https/socks5
+	Check RateLimit `mapstructure:"check"` // /check接口
+	Api   RateLimit `mapstructure:"api"`   // 其他的api接口
+}
+
+// 限速的类型
+const (
+	rateScopeProxy = "proxy"
+	rateScopeCheck = "check"
+	rateScopeApi   = "api"
+)
+
+var (
+	DefaultRateLimits RateLimits // 默认不限制
+
+	errRateLimited = errors.New("rate limit exceeded")
+
+	rateBuckets = cache.New(10*time.Minute, time.Minute) // 用户和类型对应的*tokenBucket，长时间不用的清理掉
+	rateLock    sync.Mutex
+)
+
+// limit 对应类型的限速
+func (rl RateLimits) limit(scope string) RateLimit {
+	switch scope {
+	case rateScopeProxy:
+		return rl.Proxy
+	case rateScopeCheck:
+		return rl.Check
+	}
+	return rl.Api
+}
+
+// tokenBucket 令牌桶，按照时间补充令牌，每个请求消耗一个
+type tokenBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take 取一个令牌，没有令牌时返回需要等待的时间
+func (b *tokenBucket) take(limit RateLimit) (bool, time.Duration) {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// allowRate 是否允许这次请求，key区分用户，不允许时返回需要等待的时间
+func allowRate(scope, key string, limit RateLimit) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	k := scope + ":" + key
+	rateLock.Lock()
+	v, found := rateBuckets.Get(k)
+	if !found {
+		// 新的桶是满的
+		v = &tokenBucket{tokens: math.Max(float64(limit.Burst), 1), last: time.Now()}
+	}
+	// 每次使用后续期
+	rateBuckets.SetDefault(k, v)
+	rateLock.Unlock()
+	return v.(*tokenBucket).take(limit)
+}
+
+// rateLimitKey 登录的按照用户限速，没有登录的按照客户端ip
+func rateLimitKey(c *gin.Context) string {
+	if uid := userId(c); uid > 0 {
+		return strconv.FormatUint(uint64(uid), 10)
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// retryAfter Retry-After的秒数，至少1秒
+func retryAfter(wait time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(math.Max(wait.Seconds(), 1))))
+}
+
+// rateLimitResponse 被限速时统一返回的429
+func rateLimitResponse(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", retryAfter(wait))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, map[string]interface{}{
+		"code":    http.StatusTooManyRequests,
+		"message": fmt.Sprintf("%v, retry after %ss", errRateLimited, retryAfter(wait)),
+	})
+}
+
+// rateLimitHTTPResponse mitm中的请求被限速时返回的429，跟rateLimitResponse一致
+func rateLimitHTTPResponse(req *http.Request, wait time.Duration) *http.Response {
+	body, _ := json.Marshal(map[string]interface{}{
+		"code":    http.StatusTooManyRequests,
+		"message": fmt.Sprintf("%v, retry after %ss", errRateLimited, retryAfter(wait)),
+	})
+	resp := goproxy.NewResponse(req, "application/json; charset=utf-8", http.StatusTooManyRequests, string(body))
+	resp.Header.Set("Retry-After", retryAfter(wait))
+	return resp
+}
+
+// rateLimit 接口的限速，需要放在认证之后
+func rateLimit(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := userSetting(c.GetString(authUserKey)).RateLimit.limit(scope)
+		if ok, wait := allowRate(scope, rateLimitKey(c), limit); !ok {
+			rateLimitResponse(c, wait)
+		}
+	}
+}
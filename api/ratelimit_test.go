@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllowRate(t *testing.T) {
+	defer rateBuckets.Flush()
+
+	limit := RateLimit{Rate: 10, Burst: 2}
+	for i := 0; i < 2; i++ {
+		ok, _ := allowRate(rateScopeApi, "1", limit)
+		assert.True(t, ok)
+	}
+	ok, wait := allowRate(rateScopeApi, "1", limit)
+	assert.False(t, ok)
+	assert.True(t, wait > 0 && wait <= 100*time.Millisecond, wait)
+
+	// 不同的用户和类型分开计算
+	ok, _ = allowRate(rateScopeApi, "2", limit)
+	assert.True(t, ok)
+	ok, _ = allowRate(rateScopeCheck, "1", limit)
+	assert.True(t, ok)
+
+	// 按照速率补充令牌
+	time.Sleep(wait)
+	ok, _ = allowRate(rateScopeApi, "1", limit)
+	assert.True(t, ok)
+
+	// 不限制
+	for i := 0; i < 100; i++ {
+		ok, _ = allowRate(rateScopeApi, "1", RateLimit{})
+		assert.True(t, ok)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	defer rateBuckets.Flush()
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", RateLimit: &RateLimits{Check: RateLimit{Rate: 0.01, Burst: 1}}}})
+	defer SetUserSettings(nil)
+
+	router := gin.New()
+	auth := func(c *gin.Context) {
+		c.Set(authUserKey, "a@b.com")
+		c.Set(authUserId, uint(1))
+	}
+	ok := func(c *gin.Context) { c.String(200, "ok") }
+	router.GET("/check", auth, rateLimit(rateScopeCheck), ok)
+	router.GET("/me", auth, rateLimit(rateScopeApi), ok)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	assert.Equal(t, http.StatusOK, get("/check").Code)
+	w := get("/check")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "100", w.Header().Get("Retry-After"))
+	var result map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, float64(http.StatusTooManyRequests), result["code"])
+
+	// 其他接口没有限制
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, get("/me").Code)
+	}
+}
+
+func TestProxyServeHTTP_rateLimit(t *testing.T) {
+	setupTestDB(t)
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", RateLimit: &RateLimits{Proxy: RateLimit{Rate: 0.5, Burst: 1}}}})
+	t.Cleanup(func() {
+		SetUserSettings(nil)
+	})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	addTestUserProxy(t, "a@b.com", "1234", &models.Proxy{IP: host, Port: portNum, ProxyType: "http",
+		ProxyURL: upstream.URL, Http: true})
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	get := func() *http.Response {
+		resp, err := client.Get(target.URL)
+		if !assert.Nil(t, err) {
+			t.FailNow()
+		}
+		return resp
+	}
+	resp := get()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = get()
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	assert.Contains(t, string(body), `"code":429`)
+}
+
+func TestRateLimit_restApi(t *testing.T) {
+	setupTestDB(t)
+	defer rateBuckets.Flush()
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", RateLimit: &RateLimits{Api: RateLimit{Rate: 0.01, Burst: 1}}}})
+	defer SetUserSettings(nil)
+
+	user := addTestUserProxy(t, "a@b.com", "1234")
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	loadRestApi(router)
+
+	// 跟登录后返回的jwt一致，使用gorestful默认的key
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{
+		"UID":      user.ID,
+		"Username": user.Email,
+		"Token":    user.Token,
+	}).SignedString([]byte("%gorestful%for%everyone%who%need%"))
+	assert.Nil(t, err)
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/proxy", nil)
+		req.Header.Set("Authorization", "Token "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 用户单独配置的限速对rest接口也生效
+	assert.Equal(t, http.StatusOK, get().Code)
+	w := get()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "100", w.Header().Get("Retry-After"))
+}
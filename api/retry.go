@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"github.com/LubyRuffy/rproxy/models"
+	"log"
+	"net/http"
+)
+
+var (
+	DefaultRetries = 2 // 上游失败后默认换代理重试的次数
+)
+
+// canRetry 只有幂等并且没有请求体的请求才能换代理重试，CONNECT在转发数据之前也可以重试
+func canRetry(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodConnect:
+		return true
+	case http.MethodGet, http.MethodHead:
+		return r.ContentLength == 0
+	}
+	return false
+}
+
+// tryProxies 用代理p以及握手后的conn执行try，失败后记录到这个代理，然后从剩下的候选代理中重新选择并重试，直到成功或者用完重试次数
+// 返回最后一次使用的代理，try返回errBanned并且不再重试时连接不关闭，由返回给客户端的响应持有
+func tryProxies(ctx context.Context, uid uint, connect bool, opts *proxyOptions, addr string, p *models.Proxy, conn *upstreamConn,
+	try func(p *models.Proxy, conn *upstreamConn) error) (*models.Proxy, error) {
+	for {
+		err := try(p, conn)
+		if err == nil {
+			return p, nil
+		}
+		if err != errBanned {
+			// 被封禁的响应可能还要返回给客户端，换代理的时候才关闭
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			// 客户端断开，不是代理的问题
+			return p, err
+		}
+
+		if err != errBanned {
+			// 被封禁的只在这个域名上隔离，不影响代理的评分
+			stats.record(p.ID, err, 0)
+		}
+		// 会话绑定的代理失败了，下次重新选择
+		unpinSession(uid, opts.Session)
+		if !opts.retry() {
+			return p, err
+		}
+
+		opts.exclude(p.ID)
+		np, nconn, perr := pickProxy(ctx, uid, connect, opts, addr)
+		if perr != nil {
+			// 没有其他可用的代理，返回上游的错误
+			return p, err
+		}
+		if err == errBanned {
+			conn.Close()
+		}
+		log.Printf("proxy %s failed: %v, retry with %s", p.ProxyURL, err, np.ProxyURL)
+		p, conn = np, nconn
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestProxyServeHTTP_retry(t *testing.T) {
+	setupTestDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	// 能连通但是马上断开的上游
+	bad, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer bad.Close()
+	go func() {
+		for {
+			conn, err := bad.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	badPort := bad.Addr().(*net.TCPAddr).Port
+	badProxy := &models.Proxy{IP: "127.0.0.1", Port: badPort, ProxyType: "http",
+		ProxyURL: "http://127.0.0.1:" + strconv.Itoa(badPort), Http: true}
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	goodProxy := &models.Proxy{IP: u.Hostname(), Port: port, ProxyType: "http", ProxyURL: upstream.URL, Http: true}
+
+	// 按id轮询，先选到失败的代理
+	user := addTestUserProxy(t, "a@b.com", "1234", badProxy, goodProxy)
+
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	get := func(retries string) (int, string, http.Header) {
+		rrLock.Lock()
+		rrPositions = map[uint]int{}
+		rrLock.Unlock()
+
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		req.Header.Set("X-Rproxy-Strategy", "roundrobin")
+		req.Header.Set("X-Rproxy-Limit", "1")
+		req.Header.Set("X-Rproxy-Retries", retries)
+		req.Header.Set("X-Rproxy-Debug", "true")
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		d, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(d), resp.Header
+	}
+
+	// 失败后换代理重试
+	code, body, header := get("1")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, "2", header.Get("X-Rproxy-Attempts"))
+	assert.Equal(t, fmt.Sprintf("%d %s", goodProxy.ID, upstream.URL), header.Get("X-Rproxy-Upstream"))
+	p, _ := index.get(user.ID, badProxy.ID)
+	assert.Equal(t, 1, p.FailedCount)
+
+	// 不重试直接返回错误
+	code, _, _ = get("0")
+	assert.Equal(t, http.StatusInternalServerError, code)
+	p, _ = index.get(user.ID, badProxy.ID)
+	assert.Equal(t, 2, p.FailedCount)
+}
+
+func TestProxyServeHTTP_redial(t *testing.T) {
+	setupTestDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := io.ReadAll(r.Body)
+		w.Write(d)
+	}))
+	defer target.Close()
+
+	// 连接不上的上游，请求还没有发送
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	refusedPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	refusedProxy := &models.Proxy{IP: "127.0.0.1", Port: refusedPort, ProxyType: "http",
+		ProxyURL: "http://127.0.0.1:" + strconv.Itoa(refusedPort), Http: true}
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	goodProxy := &models.Proxy{IP: "127.0.0.1", Port: port, ProxyType: "http", ProxyURL: upstream.URL, Http: true}
+
+	// 按id轮询，先选到连接不上的代理
+	user := addTestUserProxy(t, "a@b.com", "1234", refusedProxy, goodProxy)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	rrLock.Lock()
+	rrPositions = map[uint]int{}
+	rrLock.Unlock()
+
+	// 不能重新发送的POST请求，连接失败后也可以换代理
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	req, _ := http.NewRequest(http.MethodPost, target.URL, strings.NewReader("hello"))
+	req.Header.Set("X-Rproxy-Strategy", "roundrobin")
+	req.Header.Set("X-Rproxy-Limit", "1")
+	req.Header.Set("X-Rproxy-Retries", "1")
+	req.Header.Set("X-Rproxy-Debug", "true")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.Equal(t, fmt.Sprintf("%d %s", goodProxy.ID, upstream.URL), resp.Header.Get("X-Rproxy-Upstream"))
+	p, _ := index.get(user.ID, refusedProxy.ID)
+	assert.Equal(t, 1, p.FailedCount)
+}
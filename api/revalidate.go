@@ -0,0 +1,227 @@
+package api
+
+import (
+	"errors"
+	"github.com/LubyRuffy/rproxy/checkproxy"
+	"github.com/LubyRuffy/rproxy/models"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	RevalidateInterval        = 30 * time.Minute // 定时重新检测入库代理的间隔，0表示不检测
+	RevalidateFailingInterval = 5 * time.Minute  // 最近一次失败的代理重新检测的间隔，更快确认是否恢复
+	RevalidateJitter          = 5 * time.Minute  // 在间隔上随机增加的时间，避免所有代理同时检测
+	RevalidateConcurrency     = 10               // 同时进行检测的代理数量，所有代理共用
+	RevalidateSkipUsed        = time.Minute      // 这段时间内使用过的代理不检测，推迟到下一轮
+	RevalidateTick            = 10 * time.Second // 扫描到期代理的间隔
+
+	errRevalidateFailed = errors.New("revalidate failed")
+
+	// revalidateCheck 检测一个代理，测试时可以替换
+	revalidateCheck = func(u string) *checkproxy.ProxyResult {
+		return checkproxy.RecheckUrl(u, afterCallback)
+	}
+
+	revalidator = newRevalidateScheduler()
+)
+
+// revalidateScheduler 定时重新检测入库的代理，更新延迟、匿名级别、出口ip、国家和成功失败次数
+type revalidateScheduler struct {
+	lock     sync.Mutex
+	next     map[uint]time.Time // 代理id对应的下次检测时间
+	running  map[uint]struct{}  // 正在检测的代理
+	wg       sync.WaitGroup
+	started  bool
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRevalidateScheduler() *revalidateScheduler {
+	return &revalidateScheduler{
+		next:    map[uint]time.Time{},
+		running: map[uint]struct{}{},
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// revalidateJitter 随机的延迟
+func revalidateJitter() time.Duration {
+	if RevalidateJitter <= 0 {
+		return 0
+	}
+	return time.Duration(randFloat64() * float64(RevalidateJitter))
+}
+
+// revalidateIntervalOf 最近一次失败的代理使用更短的间隔
+func revalidateIntervalOf(p *models.Proxy) time.Duration {
+	if p.LastFailedTime.Valid && !isLive(p) && RevalidateFailingInterval > 0 {
+		return RevalidateFailingInterval
+	}
+	return RevalidateInterval
+}
+
+// firstDue 第一次看到代理时的检测时间，从最后一次检查或者使用的时间开始算，没有记录的尽快检测
+func firstDue(p *models.Proxy, now time.Time) time.Time {
+	var last time.Time
+	if p.LastSuccessTime.Valid {
+		last = p.LastSuccessTime.Time
+	}
+	if p.LastFailedTime.Valid && p.LastFailedTime.Time.After(last) {
+		last = p.LastFailedTime.Time
+	}
+	if last.IsZero() {
+		return now.Add(revalidateJitter())
+	}
+	return last.Add(revalidateIntervalOf(p) + revalidateJitter())
+}
+
+// recentlyUsed 代理最近被使用过
+func recentlyUsed(pid uint, now time.Time) bool {
+	if RevalidateSkipUsed <= 0 {
+		return false
+	}
+	v, ok := lastUsed.Load(pid)
+	return ok && now.Sub(v.(time.Time)) < RevalidateSkipUsed
+}
+
+// tick 检测所有到期的代理，最早到期的优先，超过并发限制的留到下一轮
+func (s *revalidateScheduler) tick(now time.Time) {
+	ps := index.all()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	seen := make(map[uint]struct{}, len(ps))
+	var due []models.Proxy
+	for _, p := range ps {
+		seen[p.ID] = struct{}{}
+		t, ok := s.next[p.ID]
+		if !ok {
+			t = firstDue(&p, now)
+			s.next[p.ID] = t
+		}
+		// 最近选择过的或者还有隧道在转发的代理正在使用，不检测
+		if _, ok = s.running[p.ID]; ok || t.After(now) || recentlyUsed(p.ID, now) || relays.active(p.ID) {
+			continue
+		}
+		due = append(due, p)
+	}
+	// 已经删除的代理
+	for pid := range s.next {
+		if _, ok := seen[pid]; !ok {
+			delete(s.next, pid)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return s.next[due[i].ID].Before(s.next[due[j].ID])
+	})
+	for i := range due {
+		if len(s.running) >= RevalidateConcurrency {
+			break
+		}
+		s.running[due[i].ID] = struct{}{}
+		s.wg.Add(1)
+		go s.check(due[i])
+	}
+}
+
+// check 检测一个代理并更新结果
+func (s *revalidateScheduler) check(p models.Proxy) {
+	defer s.wg.Done()
+
+	err := revalidateProxy(&p)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.running, p.ID)
+	interval := RevalidateInterval
+	if err != nil && RevalidateFailingInterval > 0 {
+		interval = RevalidateFailingInterval
+	}
+	s.next[p.ID] = time.Now().Add(interval + revalidateJitter())
+}
+
+// revalidateProxy 重新检测代理，成功时更新代理的属性，成功失败都记录到统计
+func revalidateProxy(p *models.Proxy) error {
+	u, err := proxyURLOf(p)
+	if err != nil {
+		return err
+	}
+
+	r := revalidateCheck(u.String())
+	switch {
+	case r != nil && r.Valid:
+	case r != nil && r.Error != nil:
+		err = r.Error
+	default:
+		err = errRevalidateFailed
+	}
+	if err != nil {
+		stats.record(p.ID, err, 0)
+		return err
+	}
+
+	np := checkProxyOfUrl(r)
+	fields := []string{"OutIP", "ProxyLevel", "Connect", "IPv6"}
+	if np.Country != "" {
+		fields = append(fields, "Country")
+	}
+	if models.GetDB() != nil {
+		if err = models.GetDB().Model(&models.Proxy{}).Where("id=?", p.ID).Select(fields).Updates(np).Error; err != nil {
+			log.Println("[WARNING] update revalidated proxy failed:", err)
+		}
+	}
+	index.update(p.ID, func(ip *models.Proxy) {
+		ip.OutIP = np.OutIP
+		ip.ProxyLevel = np.ProxyLevel
+		ip.Connect = np.Connect
+		ip.IPv6 = np.IPv6
+		if np.Country != "" {
+			ip.Country = np.Country
+		}
+	})
+	stats.record(p.ID, nil, r.Cost)
+	return nil
+}
+
+// run 定时扫描到期的代理
+func (s *revalidateScheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(RevalidateTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.tick(now)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// start 启动定时检测，间隔为0时不检测
+func (s *revalidateScheduler) start() {
+	if RevalidateInterval <= 0 || RevalidateConcurrency <= 0 {
+		return
+	}
+	s.started = true
+	go s.run()
+}
+
+// stop 停止定时检测，等待正在进行的检测完成
+func (s *revalidateScheduler) stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		if s.started {
+			<-s.done
+		}
+	})
+	s.wg.Wait()
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"github.com/LubyRuffy/rproxy/checkproxy"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRevalidateScheduler(t *testing.T) {
+	setupTestDB(t)
+
+	oldCheck, oldConcurrency, oldJitter := revalidateCheck, RevalidateConcurrency, RevalidateJitter
+	t.Cleanup(func() {
+		revalidateCheck, RevalidateConcurrency, RevalidateJitter = oldCheck, oldConcurrency, oldJitter
+	})
+	RevalidateJitter = 0
+
+	valid := &models.Proxy{IP: "1.1.1.1", Port: 1080, ProxyType: "socks5", ProxyURL: "socks5://1.1.1.1:1080", Country: "US"}
+	failed := &models.Proxy{IP: "2.2.2.2", Port: 3128, ProxyType: "http", ProxyURL: "http://2.2.2.2:3128"}
+	used := &models.Proxy{IP: "3.3.3.3", Port: 8080, ProxyType: "http", ProxyURL: "http://3.3.3.3:8080"}
+	user := addTestUserProxy(t, "a@b.com", "123", valid, failed, used)
+
+	// 正在使用的代理不检测
+	markUsed(used)
+	t.Cleanup(func() { lastUsed.Delete(used.ID) })
+
+	var lock sync.Mutex
+	var checked []string
+	release := make(chan struct{})
+	revalidateCheck = func(u string) *checkproxy.ProxyResult {
+		<-release
+		lock.Lock()
+		checked = append(checked, u)
+		lock.Unlock()
+		if u != valid.ProxyURL {
+			return &checkproxy.ProxyResult{Error: errors.New("connect refused")}
+		}
+		up, _ := url.Parse(u)
+		return &checkproxy.ProxyResult{Valid: true, Url: u, UrlParsed: up, IP: "9.9.9.9", Port: 1080,
+			Cost: 50 * time.Millisecond, ProxyLevel: checkproxy.ProxyAnonymityElite, SupportConnect: true}
+	}
+
+	s := newRevalidateScheduler()
+	now := time.Now()
+	// 刚检测过，还没有到期
+	s.tick(now)
+	assert.Len(t, s.running, 0)
+
+	// 超过并发限制的留到下一轮
+	RevalidateConcurrency = 1
+	later := now.Add(RevalidateInterval + time.Minute)
+	s.tick(later)
+	assert.Len(t, s.running, 1)
+	s.tick(later)
+	assert.Len(t, s.running, 1)
+	close(release)
+	s.wg.Wait()
+	s.tick(later)
+	s.wg.Wait()
+	// 最早到期的优先
+	assert.Equal(t, []string{valid.ProxyURL, failed.ProxyURL}, checked)
+	stats.flushWait()
+
+	p, ok := index.get(user.ID, valid.ID)
+	assert.True(t, ok)
+	assert.Equal(t, "9.9.9.9", p.OutIP)
+	assert.Equal(t, checkproxy.ProxyAnonymityElite, p.ProxyLevel)
+	assert.Equal(t, "US", p.Country)
+	assert.EqualValues(t, 2, p.SuccessCount)
+	var dbp models.Proxy
+	assert.Nil(t, models.GetDB().Where("id=?", valid.ID).Take(&dbp).Error)
+	assert.Equal(t, "9.9.9.9", dbp.OutIP)
+	assert.True(t, dbp.Connect)
+	assert.EqualValues(t, 2, dbp.SuccessCount)
+
+	p, _ = index.get(user.ID, failed.ID)
+	assert.EqualValues(t, 1, p.FailedCount)
+	assert.Equal(t, "connect refused", p.LastError)
+	// 失败的代理更快重新检测
+	assert.True(t, s.next[failed.ID].Before(s.next[valid.ID]))
+	assert.True(t, s.next[failed.ID].Before(time.Now().Add(RevalidateFailingInterval+time.Second)))
+
+	// 删除的代理不再调度
+	index.lock.Lock()
+	delete(index.proxies, used.ID)
+	index.lock.Unlock()
+	s.tick(now)
+	s.wg.Wait()
+	_, ok = s.next[used.ID]
+	assert.False(t, ok)
+
+	// 有正在转发的隧道的代理不检测，即使很久之前才选择的
+	done := relays.add(valid.ID, func() {})
+	RevalidateConcurrency = 2
+	n := len(checked)
+	s.tick(time.Now().Add(2 * (RevalidateInterval + time.Minute)))
+	s.wg.Wait()
+	assert.Equal(t, []string{failed.ProxyURL}, checked[n:])
+	done()
+	assert.False(t, relays.active(valid.ID))
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/patrickmn/go-cache"
+	"time"
+)
+
+var (
+	SessionTTL = 10 * time.Minute // 会话绑定代理的有效期，每次使用后续期
+
+	sessionCache = cache.New(SessionTTL, time.Minute) // 会话id对应的代理id
+)
+
+func sessionKey(uid uint, session string) string {
+	return fmt.Sprintf("%d:%s", uid, session)
+}
+
+// sessionProxy 获取会话绑定的代理，没有绑定或者代理不再符合条件返回nil，被目标域名host封禁的也返回nil
+func sessionProxy(uid uint, connect bool, opts *proxyOptions, host string) *models.Proxy {
+	if opts.Session == "" {
+		return nil
+	}
+	v, found := sessionCache.Get(sessionKey(uid, opts.Session))
+	if !found {
+		return nil
+	}
+
+	p, ok := index.get(uid, v.(uint))
+	if !ok || (connect && !p.Connect) || !opts.Filter.match(&p, time.Now()) {
+		return nil
+	}
+	if _, excluded := opts.excluded[p.ID]; excluded || isBanned(p.ID, host) {
+		return nil
+	}
+	return &p
+}
+
+// pinSession 会话绑定到代理
+func pinSession(uid uint, session string, p *models.Proxy) {
+	if session == "" {
+		return
+	}
+	sessionCache.Set(sessionKey(uid, session), p.ID, SessionTTL)
+}
+
+// unpinSession 解除会话绑定
+func unpinSession(uid uint, session string) {
+	if session == "" {
+		return
+	}
+	sessionCache.Delete(sessionKey(uid, session))
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestPickProxy_session(t *testing.T) {
+	setupTestDB(t)
+
+	// 两个可以连通的代理
+	var lns []net.Listener
+	var ps []*models.Proxy
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		defer ln.Close()
+		lns = append(lns, ln)
+		port := ln.Addr().(*net.TCPAddr).Port
+		ps = append(ps, &models.Proxy{
+			IP:        "127.0.0.1",
+			Port:      port,
+			ProxyType: "http",
+			ProxyURL:  "http://127.0.0.1:" + strconv.Itoa(port),
+			Http:      true,
+		})
+	}
+	user := addTestUserProxy(t, "a@b.com", "1234", ps...)
+
+	opts := &proxyOptions{Limit: defaultLimit, Session: "abc"}
+	p, conn, err := pickProxy(context.Background(), user.ID, false, opts, "127.0.0.1:80")
+	assert.Nil(t, err)
+	conn.Close()
+	for i := 0; i < 5; i++ {
+		np, conn, err := pickProxy(context.Background(), user.ID, false, opts, "127.0.0.1:80")
+		assert.Nil(t, err)
+		assert.Equal(t, p.ID, np.ID)
+		conn.Close()
+	}
+
+	// 绑定的代理失效，切换到另一个并且重新绑定
+	for i, ln := range lns {
+		if ps[i].ID == p.ID {
+			ln.Close()
+		}
+	}
+	np, conn, err := pickProxy(context.Background(), user.ID, false, opts, "127.0.0.1:80")
+	assert.Nil(t, err)
+	conn.Close()
+	assert.NotEqual(t, p.ID, np.ID)
+	v, found := sessionCache.Get(sessionKey(user.ID, "abc"))
+	assert.True(t, found)
+	assert.Equal(t, np.ID, v.(uint))
+}
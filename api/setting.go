@@ -0,0 +1,67 @@
+package api
+
+import (
+	"strings"
+	"sync"
+)
+
+// UserSetting 用户的个性化配置，在配置文件的users节点下按照email进行配置
+type UserSetting struct {
+	Email    string `mapstructure:"email"`
+	Strategy string `mapstructure:"strategy"` // 代理选择策略，为空使用DefaultStrategy
+	Mitm     bool   `mapstructure:"mitm"`     // 解密https，隧道中的每个请求重新选择代理
+	Debug    bool   `mapstructure:"debug"`    // 响应中返回使用的上游代理信息，同X-Rproxy-Debug
+	Route    string `mapstructure:"route"`    // 默认使用的多跳路由，同X-Rproxy-Route
+
+	Cooldown  *ReuseCooldown `mapstructure:"cooldown"`  // 出口ip访问同一个域名的冷却规则，为空使用DefaultCooldown
+	Quota     *UserQuota     `mapstructure:"quota"`     // 流量、请求数和连接数的配额，为空使用DefaultQuota
+	RateLimit *RateLimits    `mapstructure:"ratelimit"` // 代理、/check以及其他接口的限速，为空使用DefaultRateLimits
+}
+
+var (
+	userSettings     = map[string]*UserSetting{}
+	userSettingsLock sync.RWMutex
+)
+
+// SetUserSettings 设置用户的个性化配置
+func SetUserSettings(settings []*UserSetting) {
+	m := make(map[string]*UserSetting, len(settings))
+	for _, s := range settings {
+		if s != nil && s.Email != "" {
+			m[strings.ToLower(s.Email)] = s
+		}
+	}
+
+	userSettingsLock.Lock()
+	userSettings = m
+	userSettingsLock.Unlock()
+}
+
+// userSetting 获取用户的配置，没有配置的项使用全局默认值
+func userSetting(email string) UserSetting {
+	userSettingsLock.RLock()
+	s, ok := userSettings[strings.ToLower(email)]
+	userSettingsLock.RUnlock()
+
+	var setting UserSetting
+	if ok {
+		setting = *s
+	}
+	setting.Email = email
+	if setting.Strategy == "" {
+		setting.Strategy = DefaultStrategy
+	}
+	if setting.Cooldown == nil {
+		cooldown := DefaultCooldown
+		setting.Cooldown = &cooldown
+	}
+	if setting.Quota == nil {
+		quota := DefaultQuota
+		setting.Quota = &quota
+	}
+	if setting.RateLimit == nil {
+		rateLimits := DefaultRateLimits
+		setting.RateLimit = &rateLimits
+	}
+	return setting
+}
@@ -0,0 +1,330 @@
+package api
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// socks5协议相关的常量，参考 RFC1928 和 RFC1929
+const (
+	socks5Version       = 0x05
+	socks5AuthVersion   = 0x01
+	socks5MethodNoAuth  = 0x00
+	socks5MethodUserPwd = 0x02
+	socks5MethodNone    = 0xff
+	socks5CmdConnect    = 0x01
+	socks5AtypIPv4      = 0x01
+	socks5AtypDomain    = 0x03
+	socks5AtypIPv6      = 0x04
+
+	socks5RepSuccess          = 0x00
+	socks5RepGeneralFailure   = 0x01
+	socks5RepNotAllowed       = 0x02
+	socks5RepHostUnreachable  = 0x04
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+)
+
+var (
+	Socks5Addr string // socks5监听地址，为空表示不启用
+
+	socks5Listener    net.Listener
+	socks5PickTimeout = 4 * defaultTimeOut // 选择代理的总时间，包括换代理重试
+
+	relays = &relayTracker{close: map[uint64]func(){}, proxies: map[uint]int{}} // 正在转发的隧道
+)
+
+// StartSocks5 启动socks5代理服务，使用跟http代理一样的代理池
+// 认证方式为用户名密码，用户名为email，密码为token；
+// 用户名后面可以跟上?开头的过滤参数，同X-Rproxy-Filter，limit同X-Rproxy-Limit，session同X-Rproxy-Session，比如：user@a.com?type=socks5&limit=1
+// 也可以使用跟http代理一样的-分隔的格式，比如：user@a.com-type-socks5-limit-1
+func StartSocks5(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	socks5Listener = ln
+
+	log.Println("socks5 server listened at:", addr)
+	return serveSocks5(ln)
+}
+
+// serveSocks5 在监听上接收socks5连接，监听关闭后等待正在处理的连接结束再返回
+func serveSocks5(ln net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Println("socks5 accept failed:", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveSocks5Conn(conn)
+		}()
+	}
+}
+
+// socks5Auth 读取客户端的认证方法并且进行用户名密码认证，成功返回gin.Context用于后续的用户信息获取
+func socks5Auth(conn net.Conn) (*gin.Context, *proxyOptions, error) {
+	// VER NMETHODS METHODS
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != socks5Version {
+		return nil, nil, errors.New("invalid socks version")
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, nil, err
+	}
+	supported := false
+	for _, m := range methods {
+		if m == socks5MethodUserPwd {
+			supported = true
+			break
+		}
+	}
+	if !supported {
+		conn.Write([]byte{socks5Version, socks5MethodNone})
+		return nil, nil, errors.New("client not support username/password auth")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5MethodUserPwd}); err != nil {
+		return nil, nil, err
+	}
+
+	// VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, nil, err
+	}
+	if buf[0] != socks5AuthVersion {
+		return nil, nil, errors.New("invalid auth version")
+	}
+	username := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return nil, nil, err
+	}
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return nil, nil, err
+	}
+
+	// 用户名中?后面是代理选项
+	user, query, _ := strings.Cut(string(username), "?")
+	opts, err := queryProxyOptions(query)
+	c := &gin.Context{}
+	if err != nil || !TokenAuth(c, user+":"+string(password)) {
+		conn.Write([]byte{socks5AuthVersion, 0x01})
+		return nil, nil, errors.New("invalid auth")
+	}
+	if _, err = conn.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+		return nil, nil, err
+	}
+	if err = opts.complete(c); err != nil {
+		return nil, nil, err
+	}
+	return c, opts, nil
+}
+
+// socks5ReadRequest 读取请求，返回目标地址
+func socks5ReadRequest(conn net.Conn) (string, error) {
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[0] != socks5Version {
+		return "", errors.New("invalid socks version")
+	}
+	if buf[1] != socks5CmdConnect {
+		socks5Reply(conn, socks5RepCmdNotSupported)
+		return "", errors.New("only support connect command")
+	}
+
+	var host string
+	switch buf[3] {
+	case socks5AtypIPv4:
+		if _, err := io.ReadFull(conn, buf[:net.IPv4len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socks5AtypIPv6:
+		if _, err := io.ReadFull(conn, buf[:net.IPv6len]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socks5AtypDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		l := buf[0]
+		if _, err := io.ReadFull(conn, buf[:l]); err != nil {
+			return "", err
+		}
+		host = string(buf[:l])
+	default:
+		socks5Reply(conn, socks5RepAtypNotSupported)
+		return "", errors.New("unknown address type")
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// socks5Reply 返回请求结果，绑定地址统一为0.0.0.0:0
+func socks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// relayTracker 正在转发的隧道，hijack之后http服务器不再管理这些连接，停止服务时需要单独关闭
+type relayTracker struct {
+	lock    sync.Mutex
+	seq     uint64
+	close   map[uint64]func()
+	proxies map[uint]int // 代理id对应正在转发的隧道数
+	wg      sync.WaitGroup
+}
+
+// add 登记一个经过代理pid的隧道，pid为0表示不属于某个代理，返回隧道结束时调用的函数
+func (t *relayTracker) add(pid uint, closeAll func()) func() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.seq++
+	id := t.seq
+	t.close[id] = closeAll
+	if pid > 0 {
+		t.proxies[pid]++
+	}
+	t.wg.Add(1)
+	return func() {
+		t.lock.Lock()
+		delete(t.close, id)
+		if pid > 0 {
+			if t.proxies[pid]--; t.proxies[pid] <= 0 {
+				delete(t.proxies, pid)
+			}
+		}
+		t.lock.Unlock()
+		t.wg.Done()
+	}
+}
+
+// active 代理是否有正在转发的隧道
+func (t *relayTracker) active(pid uint) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.proxies[pid] > 0
+}
+
+// closeWait 关闭所有的隧道并且等待转发结束
+func (t *relayTracker) closeWait() {
+	t.lock.Lock()
+	for _, f := range t.close {
+		f()
+	}
+	t.lock.Unlock()
+	t.wg.Wait()
+}
+
+// relay 双向转发数据，任意一端结束都关闭两端，pid为b经过的代理
+func relay(pid uint, a, b net.Conn) {
+	var once sync.Once
+	closeAll := func() {
+		a.Close()
+		b.Close()
+	}
+	done := relays.add(pid, func() { once.Do(closeAll) })
+	defer done()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		once.Do(closeAll)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		once.Do(closeAll)
+	}()
+	wg.Wait()
+}
+
+func serveSocks5Conn(conn net.Conn) {
+	defer conn.Close()
+
+	// 握手阶段设置超时，避免空连接占用
+	conn.SetDeadline(time.Now().Add(defaultTimeOut))
+	c, opts, err := socks5Auth(conn)
+	if err != nil {
+		return
+	}
+	addr, err := socks5ReadRequest(conn)
+	if err != nil {
+		return
+	}
+	// 请求已经读完，选择代理可能要测试多轮，不能受握手超时的限制
+	conn.SetDeadline(time.Time{})
+
+	uid := userId(c)
+	if ok, _ := allowRate(rateScopeProxy, rateLimitKey(c), opts.rate); !ok {
+		socks5Reply(conn, socks5RepNotAllowed)
+		return
+	}
+	release, err := usage.begin(uid, opts.quota)
+	if err != nil {
+		socks5Reply(conn, socks5RepNotAllowed)
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), socks5PickTimeout)
+	defer cancel()
+	p, remote, err := pickProxy(ctx, uid, true, opts, addr)
+	if err != nil {
+		socks5Reply(conn, socks5RepHostUnreachable)
+		return
+	}
+
+	// 选择代理时已经建立了到目标的隧道，收发的字节数计入用户的用量
+	log.Printf("socks5 fetch %s from %s", addr, p.ProxyURL)
+	tunnel := &countingConn{Conn: remote, counter: usageCounter{uid: uid}}
+	defer tunnel.Close()
+
+	if err = socks5Reply(conn, socks5RepSuccess); err != nil {
+		return
+	}
+
+	relay(p.ID, conn, tunnel)
+}
+
+// StopSocks5 停止socks5服务
+func StopSocks5() error {
+	if socks5Listener != nil {
+		return socks5Listener.Close()
+	}
+	return nil
+}
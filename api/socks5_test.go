@@ -0,0 +1,94 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"h12.io/socks"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestSocks5(t *testing.T) {
+	setupTestDB(t)
+
+	// 目标网站
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	// 上游http代理
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	addTestUserProxy(t, "a@b.com", "1234", &models.Proxy{
+		IP:        u.Hostname(),
+		Port:      port,
+		ProxyType: "http",
+		ProxyURL:  upstream.URL,
+		Http:      true,
+		Connect:   true,
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		serveSocks5(ln)
+		close(done)
+	}()
+
+	// 关闭客户端保持的连接，等待转发结束，避免影响后面的测试
+	var transports []*http.Transport
+	t.Cleanup(func() {
+		for _, tr := range transports {
+			tr.CloseIdleConnections()
+		}
+		ln.Close()
+		<-done
+	})
+
+	get := func(user *url.Userinfo) (string, error) {
+		proxyUrl := &url.URL{Scheme: "socks5", User: user, Host: ln.Addr().String()}
+		tr := &http.Transport{Dial: socks.Dial(proxyUrl.String())}
+		transports = append(transports, tr)
+		client := &http.Client{Transport: tr}
+		resp, err := client.Get(target.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		d, err := io.ReadAll(resp.Body)
+		return string(d), err
+	}
+
+	// 认证通过
+	body, err := get(url.UserPassword("a@b.com", "1234"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", body)
+
+	// 带过滤参数
+	body, err = get(url.UserPassword("a@b.com?type=http&limit=1", "1234"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", body)
+
+	// 用户名中带有选项
+	body, err = get(url.UserPassword("a@b.com-type-http-limit-1", "1234"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", body)
+
+	// 过滤后没有代理
+	_, err = get(url.UserPassword("a@b.com?type=socks5", "1234"))
+	assert.NotNil(t, err)
+
+	// 认证失败
+	_, err = get(url.UserPassword("a@b.com", "4321"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"gorm.io/gorm"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	StatsFlushInterval = 5 * time.Second // 统计数据写库的间隔
+	StatsBatchSize     = 1000            // 待写入的代理数量达到后立即写库
+
+	stats = newStatsWriter() // 全局的统计写入
+)
+
+// statsEvent 代理的一次使用结果
+type statsEvent struct {
+	ProxyID uint
+	Time    time.Time
+	Error   string // 为空表示成功
+	Latency int64  // 更新后的延迟，单位为ms，0表示不更新
+}
+
+// proxyStats 一个代理待写库的统计数据
+type proxyStats struct {
+	Success     int
+	Failed      int
+	LastSuccess time.Time
+	LastFailed  time.Time
+	LastError   string
+	Latency     int64
+}
+
+// statsWriter 代理成功失败次数的异步批量写入
+// 内存索引立即更新，数据库按批次用原子加的方式写入，不会覆盖其他地方对同一行的修改
+type statsWriter struct {
+	ch       chan statsEvent
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	pending  map[uint]*proxyStats
+}
+
+func newStatsWriter() *statsWriter {
+	w := &statsWriter{
+		ch:       make(chan statsEvent, 10000),
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		pending:  map[uint]*proxyStats{},
+	}
+	go w.run()
+	return w
+}
+
+// record 记录代理的使用结果，latency为0表示不更新延迟
+func (w *statsWriter) record(pid uint, err error, latency time.Duration) {
+	e := statsEvent{ProxyID: pid, Time: time.Now()}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	// 先更新索引，选择代理时可以马上用到
+	index.update(pid, func(p *models.Proxy) {
+		if err != nil {
+			p.FailedCount++
+			p.LastFailedTime.Time = e.Time
+			p.LastFailedTime.Valid = true
+			p.LastError = e.Error
+			return
+		}
+		p.SuccessCount++
+		p.LastSuccessTime.Time = e.Time
+		p.LastSuccessTime.Valid = true
+		if latency > 0 {
+			// 平滑处理，避免一次波动影响太大
+			if p.Latency > 0 {
+				p.Latency = (p.Latency*4 + latency.Milliseconds()) / 5
+			} else {
+				p.Latency = latency.Milliseconds()
+			}
+			e.Latency = p.Latency
+		}
+	})
+
+	select {
+	case w.ch <- e:
+	case <-w.quit:
+		log.Println("[WARNING] stats writer stopped, drop event of proxy:", pid)
+	}
+}
+
+func (w *statsWriter) add(e statsEvent) {
+	st, ok := w.pending[e.ProxyID]
+	if !ok {
+		st = &proxyStats{}
+		w.pending[e.ProxyID] = st
+	}
+	if e.Error != "" {
+		st.Failed++
+		st.LastFailed = e.Time
+		st.LastError = e.Error
+	} else {
+		st.Success++
+		st.LastSuccess = e.Time
+	}
+	if e.Latency > 0 {
+		st.Latency = e.Latency
+	}
+}
+
+func (w *statsWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(StatsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-w.ch:
+			w.add(e)
+			if len(w.pending) >= StatsBatchSize {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		case req := <-w.flushReq:
+			w.drain()
+			w.flush()
+			close(req)
+		case <-w.quit:
+			w.drain()
+			w.flush()
+			return
+		}
+	}
+}
+
+// drain 取出队列中剩余的事件
+func (w *statsWriter) drain() {
+	for {
+		select {
+		case e := <-w.ch:
+			w.add(e)
+		default:
+			return
+		}
+	}
+}
+
+// flush 写入数据库，每个代理一条原子加的update语句，放在一个事务中
+func (w *statsWriter) flush() {
+	if len(w.pending) == 0 || models.GetDB() == nil {
+		return
+	}
+
+	err := models.GetDB().Transaction(func(tx *gorm.DB) error {
+		for pid, st := range w.pending {
+			updates := map[string]interface{}{}
+			if st.Success > 0 {
+				updates["success_count"] = gorm.Expr("success_count+?", st.Success)
+				updates["last_success_time"] = st.LastSuccess
+			}
+			if st.Failed > 0 {
+				updates["failed_count"] = gorm.Expr("failed_count+?", st.Failed)
+				updates["last_failed_time"] = st.LastFailed
+				updates["last_error"] = st.LastError
+			}
+			if st.Latency > 0 {
+				updates["latency"] = st.Latency
+			}
+			if err := tx.Model(&models.Proxy{}).Where("id=?", pid).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("[WARNING] flush proxy stats failed:", err)
+		return
+	}
+	w.pending = map[uint]*proxyStats{}
+}
+
+// flushWait 立即写入数据库，返回时已经写完
+func (w *statsWriter) flushWait() {
+	req := make(chan struct{})
+	select {
+	case w.flushReq <- req:
+		<-req
+	case <-w.done:
+	}
+}
+
+// stop 停止并且写入剩余的数据
+func (w *statsWriter) stop() {
+	w.stopOnce.Do(func() {
+		close(w.quit)
+	})
+	<-w.done
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestStatsWriter(t *testing.T) {
+	setupTestDB(t)
+
+	p := &models.Proxy{IP: "127.0.0.1", Port: 1, ProxyType: "http", ProxyURL: "http://127.0.0.1:1"}
+	user := addTestUserProxy(t, "a@b.com", "1234", p)
+	stats.flushWait()
+
+	var dbp models.Proxy
+	assert.Nil(t, models.GetDB().Take(&dbp, p.ID).Error)
+	base := dbp.SuccessCount
+
+	stats.record(p.ID, nil, 100*time.Millisecond)
+	stats.record(p.ID, nil, 0)
+	stats.record(p.ID, errors.New("timeout"), 0)
+
+	// 索引立即更新
+	ip, ok := index.get(user.ID, p.ID)
+	assert.True(t, ok)
+	assert.Equal(t, base+2, ip.SuccessCount)
+	assert.Equal(t, 1, ip.FailedCount)
+	assert.Equal(t, "timeout", ip.LastError)
+	assert.Equal(t, int64(100), ip.Latency)
+
+	// 写库之前其他地方的修改不会被覆盖
+	assert.Nil(t, models.GetDB().Model(&models.Proxy{}).Where("id=?", p.ID).
+		Updates(map[string]interface{}{"success_count": base + 10, "country": "US"}).Error)
+
+	stats.flushWait()
+	dbp = models.Proxy{}
+	assert.Nil(t, models.GetDB().Take(&dbp, p.ID).Error)
+	assert.Equal(t, base+12, dbp.SuccessCount)
+	assert.Equal(t, 1, dbp.FailedCount)
+	assert.Equal(t, "timeout", dbp.LastError)
+	assert.Equal(t, "US", dbp.Country)
+	assert.Equal(t, int64(100), dbp.Latency)
+	assert.True(t, dbp.LastFailedTime.Valid)
+}
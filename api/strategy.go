@@ -0,0 +1,137 @@
+package api
+
+import (
+	"github.com/LubyRuffy/rproxy/models"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StrategyFunc 代理选择策略，从候选代理中按照优先级选出limit个进行测试
+type StrategyFunc func(uid uint, ps []models.Proxy, limit int) []models.Proxy
+
+var (
+	DefaultStrategy = "random"         // 默认的代理选择策略
+	ScoreHalfLife   = 30 * time.Minute // 失败的影响衰减一半的时间
+
+	// Strategies 支持的代理选择策略，可以扩展
+	Strategies = map[string]StrategyFunc{
+		"random":     randomStrategy,
+		"weighted":   weightedStrategy,
+		"latency":    latencyStrategy,
+		"lru":        lruStrategy,
+		"roundrobin": roundRobinStrategy,
+	}
+
+	lastUsed     sync.Map // 代理id对应的最后使用时间，用于lru
+	rrLock       sync.Mutex
+	rrPositions  = map[uint]int{} // 用户对应的轮询位置，用于roundrobin
+	strategyRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randLock     sync.Mutex
+)
+
+// proxyScore 代理的评分，0到1之间
+// 基础分是平滑后的成功率；如果最近一次是失败，按照失败到现在的时间进行衰减，刚失败的代理接近0分，过了几个半衰期后恢复
+func proxyScore(p *models.Proxy, now time.Time) float64 {
+	score := float64(p.SuccessCount+1) / float64(p.SuccessCount+p.FailedCount+2)
+	if p.LastFailedTime.Valid && (!p.LastSuccessTime.Valid || p.LastFailedTime.Time.After(p.LastSuccessTime.Time)) {
+		elapsed := now.Sub(p.LastFailedTime.Time)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		score *= 1 - math.Pow(0.5, float64(elapsed)/float64(ScoreHalfLife))
+	}
+	return score
+}
+
+// markUsed 记录代理的使用时间
+func markUsed(p *models.Proxy) {
+	lastUsed.Store(p.ID, time.Now())
+}
+
+func topN(ps []models.Proxy, limit int) []models.Proxy {
+	if limit > 0 && len(ps) > limit {
+		return ps[:limit]
+	}
+	return ps
+}
+
+func randFloat64() float64 {
+	randLock.Lock()
+	defer randLock.Unlock()
+	return strategyRand.Float64()
+}
+
+// randomStrategy 随机选择
+func randomStrategy(uid uint, ps []models.Proxy, limit int) []models.Proxy {
+	randLock.Lock()
+	strategyRand.Shuffle(len(ps), func(i, j int) {
+		ps[i], ps[j] = ps[j], ps[i]
+	})
+	randLock.Unlock()
+	return topN(ps, limit)
+}
+
+// weightedStrategy 按照评分加权随机选择，评分越高越容易被选中
+func weightedStrategy(uid uint, ps []models.Proxy, limit int) []models.Proxy {
+	now := time.Now()
+	keys := make(map[uint]float64, len(ps))
+	for i := range ps {
+		// 加权随机抽样：key=rand^(1/weight)，取key最大的几个
+		w := math.Max(proxyScore(&ps[i], now), 0.0001)
+		keys[ps[i].ID] = math.Pow(randFloat64(), 1/w)
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return keys[ps[i].ID] > keys[ps[j].ID]
+	})
+	return topN(ps, limit)
+}
+
+// latencyStrategy 延迟最低的优先，延迟会除以评分，最近失败的代理排到后面
+func latencyStrategy(uid uint, ps []models.Proxy, limit int) []models.Proxy {
+	now := time.Now()
+	latency := make(map[uint]float64, len(ps))
+	for i := range ps {
+		latency[ps[i].ID] = float64(ps[i].Latency+1) / math.Max(proxyScore(&ps[i], now), 0.0001)
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return latency[ps[i].ID] < latency[ps[j].ID]
+	})
+	return topN(ps, limit)
+}
+
+// lruStrategy 最久没有使用过的优先
+func lruStrategy(uid uint, ps []models.Proxy, limit int) []models.Proxy {
+	used := make(map[uint]time.Time, len(ps))
+	for i := range ps {
+		if v, ok := lastUsed.Load(ps[i].ID); ok {
+			used[ps[i].ID] = v.(time.Time)
+		}
+	}
+	sort.SliceStable(ps, func(i, j int) bool {
+		return used[ps[i].ID].Before(used[ps[j].ID])
+	})
+	return topN(ps, limit)
+}
+
+// roundRobinStrategy 按照id顺序轮询，每次请求从下一个代理开始
+func roundRobinStrategy(uid uint, ps []models.Proxy, limit int) []models.Proxy {
+	if len(ps) == 0 {
+		return ps
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].ID < ps[j].ID
+	})
+
+	rrLock.Lock()
+	pos := rrPositions[uid] % len(ps)
+	rrPositions[uid] = pos + 1
+	rrLock.Unlock()
+
+	ordered := make([]models.Proxy, 0, len(ps))
+	ordered = append(ordered, ps[pos:]...)
+	ordered = append(ordered, ps[:pos]...)
+	return topN(ordered, limit)
+}
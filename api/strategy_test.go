@@ -0,0 +1,65 @@
+package api
+
+import (
+	"database/sql"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestProxyScore(t *testing.T) {
+	now := time.Now()
+	good := &models.Proxy{SuccessCount: 100, FailedCount: 1,
+		LastSuccessTime: sql.NullTime{Time: now.Add(-time.Minute), Valid: true}}
+	// 成功次数很多，但是刚刚失败了
+	justFailed := &models.Proxy{SuccessCount: 100, FailedCount: 1,
+		LastSuccessTime: sql.NullTime{Time: now.Add(-time.Hour), Valid: true},
+		LastFailedTime:  sql.NullTime{Time: now, Valid: true}}
+	// 很久之前失败的，已经恢复
+	oldFailed := &models.Proxy{SuccessCount: 100, FailedCount: 1,
+		LastSuccessTime: sql.NullTime{Time: now.Add(-10 * time.Hour), Valid: true},
+		LastFailedTime:  sql.NullTime{Time: now.Add(-5 * time.Hour), Valid: true}}
+	bad := &models.Proxy{SuccessCount: 1, FailedCount: 100}
+
+	assert.InDelta(t, 0, proxyScore(justFailed, now), 0.01)
+	assert.Greater(t, proxyScore(good, now), proxyScore(bad, now))
+	assert.Greater(t, proxyScore(oldFailed, now), proxyScore(justFailed, now))
+	assert.InDelta(t, proxyScore(good, now), proxyScore(oldFailed, now), 0.01)
+}
+
+func TestStrategies(t *testing.T) {
+	ps := []models.Proxy{
+		{Latency: 300},
+		{Latency: 100},
+		{Latency: 200},
+	}
+	for i := range ps {
+		ps[i].ID = uint(i + 1)
+	}
+
+	// 延迟
+	r := latencyStrategy(1, append([]models.Proxy{}, ps...), 2)
+	assert.Len(t, r, 2)
+	assert.Equal(t, uint(2), r[0].ID)
+	assert.Equal(t, uint(3), r[1].ID)
+
+	// 轮询
+	var first []uint
+	for i := 0; i < 4; i++ {
+		r = roundRobinStrategy(100, append([]models.Proxy{}, ps...), 1)
+		first = append(first, r[0].ID)
+	}
+	assert.Equal(t, []uint{1, 2, 3, 1}, first)
+
+	// lru，使用过的排到后面
+	markUsed(&ps[0])
+	markUsed(&ps[1])
+	r = lruStrategy(1, append([]models.Proxy{}, ps...), 3)
+	assert.Equal(t, uint(3), r[0].ID)
+	assert.Equal(t, uint(1), r[1].ID)
+
+	// 随机和加权随机都返回limit个
+	assert.Len(t, randomStrategy(1, append([]models.Proxy{}, ps...), 2), 2)
+	assert.Len(t, weightedStrategy(1, append([]models.Proxy{}, ps...), 2), 2)
+}
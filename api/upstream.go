@@ -0,0 +1,307 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// upstreamHandshake 在已经连接到上游代理的conn上建立到addr的隧道
+type upstreamHandshake func(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error)
+
+var (
+	// upstreamHandshakes 各种代理类型的握手
+	upstreamHandshakes = map[string]upstreamHandshake{
+		"http":    httpConnectHandshake,
+		"https":   httpConnectHandshake,
+		"socks4":  socks4Handshake,
+		"socks4a": socks4aHandshake,
+		"socks5":  socks5Handshake,
+	}
+)
+
+// upstreamConn 经过握手的上游连接
+type upstreamConn struct {
+	net.Conn
+	Tunnel bool     // 已经建立了到目标的隧道，否则只是连接到了http代理，需要发送代理格式的请求，https代理的tls已经完成
+	Proxy  *url.URL // 最后一跳的代理，没有隧道的时候按照这个代理的格式发送请求
+
+	hops []*url.URL // 依次连接的代理，重新连接时使用
+}
+
+// dialUpstream 连接上游代理并且进行协议握手，connect表示需要隧道，route不为空时按照路由经过多跳连接
+// http代理的普通请求没有单独的握手，只建立tcp连接（https代理完成tls握手），请求本身失败后由重试换代理
+func dialUpstream(ctx context.Context, p *models.Proxy, route *Route, addr string, connect bool) (*upstreamConn, error) {
+	hops, err := route.chain(p)
+	if err != nil {
+		return nil, err
+	}
+	return dialChain(ctx, hops, addr, connect)
+}
+
+// dialChain 连接第一跳，然后在前一跳上依次建立到下一跳的隧道，最后一跳建立到addr的隧道
+func dialChain(ctx context.Context, hops []*url.URL, addr string, connect bool) (*upstreamConn, error) {
+	for _, u := range hops {
+		if _, ok := upstreamHandshakes[u.Scheme]; !ok {
+			return nil, fmt.Errorf("unsupported proxy type: %s", u.Scheme)
+		}
+	}
+
+	d := net.Dialer{Timeout: defaultTimeOut}
+	conn, err := d.DialContext(ctx, "tcp", hops[0].Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(defaultTimeOut))
+
+	for i, u := range hops {
+		if u.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, ServerName: u.Hostname()})
+			if err = tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+
+		next := addr
+		if i < len(hops)-1 {
+			next = hops[i+1].Host
+		} else if addr == "" || (!connect && (u.Scheme == "http" || u.Scheme == "https")) {
+			conn.SetDeadline(time.Time{})
+			return &upstreamConn{Conn: conn, Proxy: u, hops: hops}, nil
+		}
+
+		tunnel, err := upstreamHandshakes[u.Scheme](ctx, conn, u, next)
+		if err != nil {
+			conn.Close()
+			if i < len(hops)-1 {
+				return nil, fmt.Errorf("hop %s: %v", u.Host, err)
+			}
+			return nil, err
+		}
+		conn = tunnel
+	}
+	conn.SetDeadline(time.Time{})
+	return &upstreamConn{Conn: conn, Tunnel: true, Proxy: hops[len(hops)-1], hops: hops}, nil
+}
+
+// bufferedConn 读取握手响应时多读的数据要先返回
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpConnectHandshake http代理，发送CONNECT请求
+func httpConnectHandshake(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		pwd, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pwd)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy connect failed: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// splitHostPort 拆分目标地址
+func splitHostPort(addr string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port: %s", port)
+	}
+	return host, uint16(portNum), nil
+}
+
+// socks5Handshake socks5代理，协商认证方法，有用户名的时候用用户名密码认证，然后发送CONNECT请求
+func socks5Handshake(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5MethodNoAuth)
+	if u.User != nil {
+		method = socks5MethodUserPwd
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 262)
+	if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socks5Version || buf[1] != method {
+		return nil, errors.New("socks5 auth method not accepted")
+	}
+
+	if method == socks5MethodUserPwd {
+		user := u.User.Username()
+		pwd, _ := u.User.Password()
+		if len(user) > 255 || len(pwd) > 255 {
+			return nil, errors.New("socks5 user or password too long")
+		}
+		req := []byte{socks5AuthVersion, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pwd)))
+		req = append(req, pwd...)
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		if _, err = io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		if buf[1] != 0x00 {
+			return nil, errors.New("socks5 auth failed")
+		}
+	}
+
+	// VER CMD RSV ATYP DST.ADDR DST.PORT
+	req := []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AtypIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AtypIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, errors.New("socks5 host too long")
+		}
+		req = append(req, socks5AtypDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// VER REP RSV ATYP BND.ADDR BND.PORT，绑定地址要读完
+	if _, err = io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[1] != socks5RepSuccess {
+		return nil, fmt.Errorf("socks5 connect failed: %d", buf[1])
+	}
+	var l int
+	switch buf[3] {
+	case socks5AtypIPv4:
+		l = net.IPv4len
+	case socks5AtypIPv6:
+		l = net.IPv6len
+	case socks5AtypDomain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		l = int(buf[0])
+	default:
+		return nil, errors.New("unknown socks5 address type")
+	}
+	if _, err = io.ReadFull(conn, buf[:l+2]); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks4Handshake socks4代理，只支持ipv4，域名在本地解析
+func socks4Handshake(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	return socks4Connect(ctx, conn, u, addr, false)
+}
+
+// socks4aHandshake socks4a代理，域名由代理解析
+func socks4aHandshake(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	return socks4Connect(ctx, conn, u, addr, true)
+}
+
+// socks4Connect 发送socks4的CONNECT请求，remoteResolve为true时使用socks4a的方式把域名发给代理
+func socks4Connect(ctx context.Context, conn net.Conn, u *url.URL, addr string, remoteResolve bool) (net.Conn, error) {
+	host, port, err := splitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(host).To4()
+	domain := ""
+	if ip == nil {
+		if remoteResolve {
+			// 0.0.0.x表示后面跟着域名
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			domain = host
+		} else {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+			if err != nil {
+				return nil, err
+			}
+			if len(ips) == 0 {
+				return nil, fmt.Errorf("no ipv4 address of %s", host)
+			}
+			ip = ips[0].To4()
+		}
+	}
+
+	// VN CD DSTPORT DSTIP USERID NULL [DOMAIN NULL]
+	req := []byte{0x04, 0x01}
+	req = append(req, byte(port>>8), byte(port))
+	req = append(req, ip...)
+	if u.User != nil {
+		req = append(req, u.User.Username()...)
+	}
+	req = append(req, 0x00)
+	if domain != "" {
+		req = append(req, domain...)
+		req = append(req, 0x00)
+	}
+	if _, err = conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	if buf[1] != 0x5a {
+		return nil, fmt.Errorf("socks4 connect failed: %d", buf[1])
+	}
+	return conn, nil
+}
@@ -0,0 +1,318 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFastestProxy_handshake(t *testing.T) {
+	setupTestDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	addr := target.Listener.Addr().String()
+
+	// 能连通但是已经不能代理的端口，tcp连接成功，握手失败
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer dead.Close()
+	go func() {
+		for {
+			conn, err := dead.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	deadPort := dead.Addr().(*net.TCPAddr).Port
+	deadProxy := &models.Proxy{IP: "127.0.0.1", Port: deadPort, ProxyType: "http",
+		ProxyURL: "http://127.0.0.1:" + strconv.Itoa(deadPort), Http: true, Connect: true}
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	goodProxy := &models.Proxy{IP: u.Hostname(), Port: port, ProxyType: "http", ProxyURL: upstream.URL,
+		Http: true, Connect: true}
+
+	user := addTestUserProxy(t, "a@b.com", "1234", deadProxy, goodProxy)
+	opts := newProxyOptions()
+	for i := 0; i < 3; i++ {
+		p, conn, err := pickProxy(context.Background(), user.ID, true, opts, addr)
+		assert.Nil(t, err)
+		assert.Equal(t, goodProxy.ID, p.ID)
+		assert.True(t, conn.Tunnel)
+
+		// 握手后的连接直接用于请求
+		req, _ := http.NewRequest(http.MethodGet, target.URL, nil)
+		assert.Nil(t, req.Write(conn))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		assert.Nil(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "ok", string(body))
+		conn.Close()
+	}
+
+	p, _ := index.get(user.ID, deadProxy.ID)
+	assert.Equal(t, 3, p.FailedCount)
+}
+
+func TestProxyServeHTTP_noTargetProbe(t *testing.T) {
+	setupTestDB(t)
+
+	var lock sync.Mutex
+	var received []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		received = append(received, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	var ps []*models.Proxy
+	for i := 0; i < 3; i++ {
+		upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+		defer upstream.Close()
+		port := upstream.Listener.Addr().(*net.TCPAddr).Port
+		ps = append(ps, &models.Proxy{IP: "127.0.0.1", Port: port, ProxyType: "http", ProxyURL: upstream.URL, Http: true})
+	}
+	addTestUserProxy(t, "a@b.com", "1234", ps...)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	// 同时测试三个候选代理，只有真正的请求到达目标
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	req, _ := http.NewRequest(http.MethodPost, target.URL+"/login", strings.NewReader("user=a"))
+	req.Header.Set("X-Rproxy-Limit", "3")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, []string{"POST /login"}, received)
+}
+
+// fakeSocksServer 测试用的socks4/socks4a/socks5上游，不需要认证，记录收到的协议
+type fakeSocksServer struct {
+	net.Listener
+	lock sync.Mutex
+	seen map[string]int
+}
+
+func newFakeSocksServer(t *testing.T) *fakeSocksServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	s := &fakeSocksServer{Listener: ln, seen: map[string]int{}}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSocksServer) count(protocol string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.seen[protocol]
+}
+
+func (s *fakeSocksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	ver, err := br.ReadByte()
+	if err != nil {
+		return
+	}
+
+	var protocol, addr string
+	buf := make([]byte, 256)
+	switch ver {
+	case 0x04:
+		// CD DSTPORT DSTIP USERID NULL [DOMAIN NULL]
+		if _, err = io.ReadFull(br, buf[:7]); err != nil {
+			return
+		}
+		port := int(buf[1])<<8 | int(buf[2])
+		ip := net.IP(append([]byte{}, buf[3:7]...))
+		if _, err = br.ReadString(0); err != nil {
+			return
+		}
+		protocol, addr = "socks4", net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+			domain, err := br.ReadString(0)
+			if err != nil {
+				return
+			}
+			protocol, addr = "socks4a", net.JoinHostPort(domain[:len(domain)-1], strconv.Itoa(port))
+		}
+		conn.Write([]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0})
+	case socks5Version:
+		// NMETHODS METHODS
+		if _, err = io.ReadFull(br, buf[:1]); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(br, buf[:buf[0]]); err != nil {
+			return
+		}
+		conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+		if addr, err = socks5ReadRequest(&bufferedConn{Conn: conn, r: br}); err != nil {
+			return
+		}
+		protocol = "socks5"
+		socks5Reply(conn, socks5RepSuccess)
+	default:
+		return
+	}
+
+	s.lock.Lock()
+	s.seen[protocol]++
+	s.lock.Unlock()
+
+	remote, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	relay(0, &bufferedConn{Conn: conn, r: br}, remote)
+}
+
+func TestProxyServeHTTP_upstreams(t *testing.T) {
+	setupTestDB(t)
+
+	httpTarget := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("http ok"))
+	}))
+	defer httpTarget.Close()
+	httpsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("https ok"))
+	}))
+	defer httpsTarget.Close()
+
+	// 各种类型的本地上游
+	httpUpstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer httpUpstream.Close()
+	httpsUpstream := httptest.NewTLSServer(goproxy.NewProxyHttpServer())
+	defer httpsUpstream.Close()
+	socksUpstream := newFakeSocksServer(t)
+
+	newProxy := func(proxyType, host string) *models.Proxy {
+		h, port, _ := net.SplitHostPort(host)
+		p, _ := strconv.Atoi(port)
+		return &models.Proxy{IP: h, Port: p, ProxyType: proxyType, ProxyURL: proxyType + "://" + host,
+			Http: true, Connect: true}
+	}
+	addTestUserProxy(t, "a@b.com", "1234",
+		newProxy("http", httpUpstream.Listener.Addr().String()),
+		newProxy("https", httpsUpstream.Listener.Addr().String()),
+		newProxy("socks4", socksUpstream.Addr().String()),
+		newProxy("socks4a", socksUpstream.Addr().String()),
+		newProxy("socks5", socksUpstream.Addr().String()),
+	)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	get := func(proxyType, target string) string {
+		filter := http.Header{}
+		filter.Set("X-Rproxy-Filter", "type="+proxyType)
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyUrl),
+			ProxyConnectHeader: filter,
+			TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		}}
+		req, _ := http.NewRequest(http.MethodGet, target, nil)
+		req.Header = filter.Clone()
+		resp, err := client.Do(req)
+		if !assert.Nil(t, err, proxyType) {
+			return ""
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	for _, proxyType := range []string{"http", "https", "socks4", "socks4a", "socks5"} {
+		// CONNECT隧道
+		assert.Equal(t, "https ok", get(proxyType, httpsTarget.URL), proxyType)
+		// 普通http请求
+		assert.Equal(t, "http ok", get(proxyType, httpTarget.URL), proxyType)
+	}
+
+	// 域名由socks4a的代理解析，ip地址还是按照socks4发送
+	assert.Equal(t, "http ok", get("socks4a", strings.Replace(httpTarget.URL, "127.0.0.1", "localhost", 1)))
+	assert.Equal(t, 4, socksUpstream.count("socks4"))
+	assert.Equal(t, 1, socksUpstream.count("socks4a"))
+	assert.Equal(t, 2, socksUpstream.count("socks5"))
+}
+
+func TestProxyServeHTTP_connectDebug(t *testing.T) {
+	setupTestDB(t)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	p := &models.Proxy{IP: u.Hostname(), Port: port, ProxyType: "http", ProxyURL: upstream.URL,
+		Http: true, Connect: true, OutIP: "1.2.3.4", Country: "US"}
+	addTestUserProxy(t, "a@b.com", "1234", p)
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	conn, err := net.Dial("tcp", proxyUrl.Host)
+	assert.Nil(t, err)
+	defer conn.Close()
+	addr := target.Listener.Addr().String()
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	req.SetBasicAuth("a@b.com", "1234")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Rproxy-Debug", "1")
+	assert.Nil(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("%d %s", p.ID, upstream.URL), resp.Header.Get("X-Rproxy-Upstream"))
+	assert.Equal(t, "1.2.3.4", resp.Header.Get("X-Rproxy-Out-IP"))
+	assert.Equal(t, "US", resp.Header.Get("X-Rproxy-Country"))
+	assert.Equal(t, "1", resp.Header.Get("X-Rproxy-Attempts"))
+
+	// 隧道可以正常使用
+	req, _ = http.NewRequest(http.MethodGet, target.URL, nil)
+	assert.Nil(t, req.Write(conn))
+	resp, err = http.ReadResponse(br, req)
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "ok", string(body))
+}
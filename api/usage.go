@@ -0,0 +1,314 @@
+package api
+
+import (
+	"errors"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UserQuota 用户的配额，在配置文件的quota节点下配置，users下可以单独覆盖，0表示不限制
+type UserQuota struct {
+	DailyBytes      int64 `mapstructure:"daily_bytes" json:"daily_bytes"`           // 每天的流量，单位为字节
+	MonthlyBytes    int64 `mapstructure:"monthly_bytes" json:"monthly_bytes"`       // 每月的流量，单位为字节
+	DailyRequests   int64 `mapstructure:"daily_requests" json:"daily_requests"`     // 每天的请求数
+	MonthlyRequests int64 `mapstructure:"monthly_requests" json:"monthly_requests"` // 每月的请求数
+	MaxConns        int   `mapstructure:"max_conns" json:"max_conns"`               // 同时进行的连接数
+}
+
+// periodUsage 一个统计周期的用量
+type periodUsage struct {
+	Period   string `json:"period"`
+	Bytes    int64  `json:"bytes"`
+	Requests int64  `json:"requests"`
+}
+
+// userUsage 用户当前的用量，周期变化后从数据库重新加载
+type userUsage struct {
+	day   periodUsage
+	month periodUsage
+	conns int
+}
+
+var (
+	DefaultQuota    UserQuota            // 默认不限制
+	UsageBatchBytes int64     = 64 << 10 // 连接上累计到这么多字节才计入用户的用量，关闭时计入剩余的
+
+	errQuotaExceeded = errors.New("quota exceeded")
+	errTooManyConns  = errors.New("too many connections")
+
+	usage = newUsageTracker() // 全局的用量统计
+)
+
+// usageTracker 用户的流量和请求数统计，内存中实时更新用于判断配额，数据库按批次用原子加的方式写入
+type usageTracker struct {
+	lock    sync.Mutex
+	users   map[uint]*userUsage
+	pending map[uint]map[string]*periodUsage // 用户和周期对应的待写入增量
+
+	flushReq chan chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newUsageTracker() *usageTracker {
+	t := &usageTracker{
+		users:    map[uint]*userUsage{},
+		pending:  map[uint]map[string]*periodUsage{},
+		flushReq: make(chan chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// loadPeriod 从数据库加载一个周期已经写入的用量
+func loadPeriod(uid uint, period string) periodUsage {
+	pu := periodUsage{Period: period}
+	if models.GetDB() == nil {
+		return pu
+	}
+	var row models.UserUsage
+	if err := models.GetDB().Where("user_id = ? AND period = ?", uid, period).Limit(1).Find(&row).Error; err == nil && row.ID > 0 {
+		pu.Bytes, pu.Requests = row.Bytes, row.Requests
+	}
+	return pu
+}
+
+// lockCurrent 加锁并返回用户当前周期的用量，调用方负责解锁
+// 周期变化或者新用户时先在锁外从数据库加载，不能在持有全局锁的时候查询数据库
+func (t *usageTracker) lockCurrent(uid uint) *userUsage {
+	now := time.Now()
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	t.lock.Lock()
+	if u, ok := t.users[uid]; ok && u.day.Period == day && u.month.Period == month {
+		return u
+	}
+	t.lock.Unlock()
+
+	dayUsage, monthUsage := loadPeriod(uid, day), loadPeriod(uid, month)
+
+	t.lock.Lock()
+	u, ok := t.users[uid]
+	if !ok {
+		u = &userUsage{}
+		t.users[uid] = u
+	}
+	// 加载期间其他请求可能已经切换了周期
+	if u.day.Period != day {
+		u.day = dayUsage
+	}
+	if u.month.Period != month {
+		u.month = monthUsage
+	}
+	return u
+}
+
+// add 记录增量，需要持有锁
+func (t *usageTracker) add(uid uint, u *userUsage, bytes, requests int64) {
+	ps, ok := t.pending[uid]
+	if !ok {
+		ps = map[string]*periodUsage{}
+		t.pending[uid] = ps
+	}
+	for _, pu := range []*periodUsage{&u.day, &u.month} {
+		pu.Bytes += bytes
+		pu.Requests += requests
+		d, ok := ps[pu.Period]
+		if !ok {
+			d = &periodUsage{Period: pu.Period}
+			ps[pu.Period] = d
+		}
+		d.Bytes += bytes
+		d.Requests += requests
+	}
+}
+
+// exceeded 是否超出了配额，需要持有锁
+func (u *userUsage) exceeded(q UserQuota) bool {
+	return (q.DailyBytes > 0 && u.day.Bytes >= q.DailyBytes) ||
+		(q.MonthlyBytes > 0 && u.month.Bytes >= q.MonthlyBytes) ||
+		(q.DailyRequests > 0 && u.day.Requests >= q.DailyRequests) ||
+		(q.MonthlyRequests > 0 && u.month.Requests >= q.MonthlyRequests)
+}
+
+// check 只检查配额，不占用连接
+func (t *usageTracker) check(uid uint, q UserQuota) error {
+	u := t.lockCurrent(uid)
+	defer t.lock.Unlock()
+	if u.exceeded(q) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// begin 开始一个请求：检查配额和连接数，记录请求数并占用一个连接，返回释放连接的函数
+func (t *usageTracker) begin(uid uint, q UserQuota) (func(), error) {
+	u := t.lockCurrent(uid)
+	defer t.lock.Unlock()
+	if u.exceeded(q) {
+		return nil, errQuotaExceeded
+	}
+	if q.MaxConns > 0 && u.conns >= q.MaxConns {
+		return nil, errTooManyConns
+	}
+	u.conns++
+	t.add(uid, u, 0, 1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.lock.Lock()
+			u.conns--
+			t.lock.Unlock()
+		})
+	}, nil
+}
+
+// addBytes 记录收发的字节数
+func (t *usageTracker) addBytes(uid uint, n int64) {
+	if n <= 0 {
+		return
+	}
+	u := t.lockCurrent(uid)
+	t.add(uid, u, n, 0)
+	t.lock.Unlock()
+}
+
+// snapshot 用户当前的用量
+func (t *usageTracker) snapshot(uid uint) userUsage {
+	u := t.lockCurrent(uid)
+	defer t.lock.Unlock()
+	return *u
+}
+
+// reset 清空内存中的用量，下次使用时从数据库重新加载
+// 正在进行的请求释放连接时还会修改原来的记录，所以只清空周期，保留连接数
+func (t *usageTracker) reset() {
+	t.lock.Lock()
+	for _, u := range t.users {
+		u.day, u.month = periodUsage{}, periodUsage{}
+	}
+	t.lock.Unlock()
+}
+
+func (t *usageTracker) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(StatsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case req := <-t.flushReq:
+			t.flush()
+			close(req)
+		case <-t.quit:
+			t.flush()
+			return
+		}
+	}
+}
+
+// flush 写入数据库，每个用户每个周期一条upsert语句，放在一个事务中
+func (t *usageTracker) flush() {
+	t.lock.Lock()
+	pending := t.pending
+	t.pending = map[uint]map[string]*periodUsage{}
+	t.lock.Unlock()
+	if len(pending) == 0 || models.GetDB() == nil {
+		return
+	}
+
+	err := models.GetDB().Transaction(func(tx *gorm.DB) error {
+		for uid, ps := range pending {
+			for _, d := range ps {
+				err := tx.Clauses(clause.OnConflict{
+					Columns: []clause.Column{{Name: "user_id"}, {Name: "period"}},
+					DoUpdates: clause.Assignments(map[string]interface{}{
+						"bytes":      gorm.Expr("bytes+?", d.Bytes),
+						"requests":   gorm.Expr("requests+?", d.Requests),
+						"updated_at": time.Now(),
+					}),
+				}).Create(&models.UserUsage{UserID: uid, Period: d.Period, Bytes: d.Bytes, Requests: d.Requests}).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("[WARNING] flush user usage failed:", err)
+	}
+}
+
+// flushWait 立即写入数据库，返回时已经写完
+func (t *usageTracker) flushWait() {
+	req := make(chan struct{})
+	select {
+	case t.flushReq <- req:
+		<-req
+	case <-t.done:
+	}
+}
+
+// stop 停止并且写入剩余的数据
+func (t *usageTracker) stop() {
+	t.stopOnce.Do(func() {
+		close(t.quit)
+	})
+	<-t.done
+}
+
+// usageCounter 每个连接单独用原子操作计数，按批次计入用户的用量，避免每次读写都加全局锁
+type usageCounter struct {
+	uid     uint
+	pending int64
+}
+
+func (c *usageCounter) add(n int) {
+	if n > 0 && atomic.AddInt64(&c.pending, int64(n)) >= UsageBatchBytes {
+		c.flush()
+	}
+}
+
+// flush 计入还没有计入的字节数
+func (c *usageCounter) flush() {
+	usage.addBytes(c.uid, atomic.SwapInt64(&c.pending, 0))
+}
+
+// releaseBody 响应内容关闭时释放连接
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// usageHandler 查看当前用户的用量和配额
+func usageHandler(c *gin.Context) {
+	u := usage.snapshot(userId(c))
+	c.JSON(200, map[string]interface{}{
+		"code": 200,
+		"data": map[string]interface{}{
+			"day":   u.day,
+			"month": u.month,
+			"conns": u.conns,
+			"quota": *userSetting(c.GetString(authUserKey)).Quota,
+		},
+	})
+}
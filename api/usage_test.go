@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bufio"
+	"github.com/LubyRuffy/rproxy/models"
+	"github.com/elazarl/goproxy"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProxyServeHTTP_quota(t *testing.T) {
+	setupTestDB(t)
+
+	SetUserSettings([]*UserSetting{{Email: "a@b.com", Quota: &UserQuota{DailyRequests: 3, MaxConns: 1}}})
+	t.Cleanup(func() {
+		SetUserSettings(nil)
+	})
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+	upstream := httptest.NewServer(goproxy.NewProxyHttpServer())
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	user := addTestUserProxy(t, "a@b.com", "1234", &models.Proxy{IP: host, Port: portNum, ProxyType: "http",
+		ProxyURL: upstream.URL, Http: true, Connect: true})
+	proxyUrl := newTestProxyServer(t, "a@b.com", "1234")
+
+	get := func() int {
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+		resp, err := client.Get(target.URL)
+		if !assert.Nil(t, err) {
+			return 0
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get())
+
+	// 隧道占用了唯一的连接
+	conn, err := net.Dial("tcp", proxyUrl.Host)
+	assert.Nil(t, err)
+	addr := target.Listener.Addr().String()
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	req.SetBasicAuth("a@b.com", "1234")
+	req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+	req.Header.Del("Authorization")
+	assert.Nil(t, req.Write(conn))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, get())
+
+	// 隧道关闭后释放
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return usage.snapshot(user.ID).conns == 0
+	}, 3*time.Second, 20*time.Millisecond)
+	assert.Equal(t, http.StatusOK, get())
+
+	// 每天的请求数用完了
+	assert.Equal(t, http.StatusTooManyRequests, get())
+	u := usage.snapshot(user.ID)
+	assert.Equal(t, int64(3), u.day.Requests)
+	assert.Equal(t, int64(3), u.month.Requests)
+	assert.Greater(t, u.day.Bytes, int64(0))
+
+	// 写入数据库后可以重新加载
+	usage.flushWait()
+	usage.reset()
+	reloaded := usage.snapshot(user.ID)
+	assert.Equal(t, u.day, reloaded.day)
+	assert.Equal(t, u.month, reloaded.month)
+	assert.Equal(t, http.StatusTooManyRequests, get())
+}
+
+func TestUsageCounter(t *testing.T) {
+	setupTestDB(t)
+
+	old := UsageBatchBytes
+	UsageBatchBytes = 100
+	t.Cleanup(func() {
+		UsageBatchBytes = old
+	})
+
+	// 不够一批的时候先不计入
+	c := &usageCounter{uid: 1}
+	c.add(60)
+	assert.Equal(t, int64(0), usage.snapshot(1).day.Bytes)
+	c.add(60)
+	assert.Equal(t, int64(120), usage.snapshot(1).day.Bytes)
+
+	// 关闭时计入剩余的
+	c.add(30)
+	c.flush()
+	c.flush()
+	assert.Equal(t, int64(150), usage.snapshot(1).day.Bytes)
+}
+
+func TestUsageTracker_reset(t *testing.T) {
+	setupTestDB(t)
+
+	q := UserQuota{MaxConns: 1}
+	release, err := usage.begin(1, q)
+	assert.Nil(t, err)
+
+	// 重新加载用量后正在进行的请求还占用着连接
+	usage.reset()
+	assert.Equal(t, 1, usage.snapshot(1).conns)
+	_, err = usage.begin(1, q)
+	assert.Equal(t, errTooManyConns, err)
+
+	release()
+	assert.Equal(t, 0, usage.snapshot(1).conns)
+	release, err = usage.begin(1, q)
+	assert.Nil(t, err)
+	release()
+}
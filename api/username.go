@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/url"
+	"strings"
+)
+
+// isUsernameKey 用户名中支持的代理选项，跟X-Rproxy-Filter的key保持一致，另外支持optionKeys中的选项
+func isUsernameKey(key string) bool {
+	if optionKeys[key] {
+		return true
+	}
+	_, ok := filterFields[key]
+	return ok
+}
+
+// parsedUsername 用户名的一种解析方式
+type parsedUsername struct {
+	email string
+	opts  url.Values
+}
+
+// parseUsername 解析带有代理选项的用户名，返回去掉选项后的email和选项
+// 格式为email-key-value-key-value，比如：user@a.com-country-us-type-socks5-level-elite-session-abc
+// email本身也可能带有-，这里取后面全部是合法key-value的最短的email；选项的值不能包含@
+func parseUsername(name string) (string, url.Values) {
+	ps := parseUsernames(name)
+	p := ps[len(ps)-1]
+	return p.email, p.opts
+}
+
+// parseUsernames 用户名所有可能的解析方式，第一个是不带选项的完整用户名，后面的email依次变短
+// email中本身就有像选项的部分时（比如bob@my-country-co.com），认证时需要依次尝试
+func parseUsernames(name string) []parsedUsername {
+	ps := []parsedUsername{{email: name}}
+	segs := strings.Split(name, "-")
+	// 从后往前每次多解析一组key-value
+	for i := len(segs) - 2; i >= 1; i -= 2 {
+		key, value := strings.ToLower(segs[i]), segs[i+1]
+		if !isUsernameKey(key) || value == "" || strings.Contains(value, "@") {
+			break
+		}
+		email := strings.Join(segs[:i], "-")
+		if email == "" {
+			break
+		}
+		opts := url.Values{}
+		for k, v := range ps[len(ps)-1].opts {
+			opts[k] = append([]string{}, v...)
+		}
+		// 从后往前解析，同一个key的值保持原来的顺序
+		opts[key] = append([]string{value}, opts[key]...)
+		ps = append(ps, parsedUsername{email: email, opts: opts})
+	}
+	return ps
+}
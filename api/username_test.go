@@ -0,0 +1,99 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseUsername(t *testing.T) {
+	email, opts := parseUsername("user@a.com")
+	assert.Equal(t, "user@a.com", email)
+	assert.Nil(t, opts)
+
+	email, opts = parseUsername("user@a.com-country-us-type-socks5-level-elite-session-abc")
+	assert.Equal(t, "user@a.com", email)
+	assert.Equal(t, url.Values{
+		"country": {"us"},
+		"type":    {"socks5"},
+		"level":   {"elite"},
+		"session": {"abc"},
+	}, opts)
+
+	// email中带有-
+	email, opts = parseUsername("john-doe@my-site.com-limit-1")
+	assert.Equal(t, "john-doe@my-site.com", email)
+	assert.Equal(t, url.Values{"limit": {"1"}}, opts)
+
+	// 不认识的key不作为选项
+	email, opts = parseUsername("user@a.com-foo-bar")
+	assert.Equal(t, "user@a.com-foo-bar", email)
+	assert.Nil(t, opts)
+
+	// 值不能为空
+	email, opts = parseUsername("user@a.com-country-")
+	assert.Equal(t, "user@a.com-country-", email)
+	assert.Nil(t, opts)
+}
+
+func TestTokenAuth_username(t *testing.T) {
+	setupTestDB(t)
+	// email的域名中带有-country-，也会被解析成选项
+	addTestUserProxy(t, "bob@my-country-co.com", "1234")
+
+	ps := parseUsernames("bob@my-country-co.com-limit-1")
+	assert.Equal(t, []parsedUsername{
+		{email: "bob@my-country-co.com-limit-1"},
+		{email: "bob@my-country-co.com", opts: url.Values{"limit": {"1"}}},
+		{email: "bob@my", opts: url.Values{"country": {"co.com"}, "limit": {"1"}}},
+	}, ps)
+
+	auth := func(token string) (bool, *gin.Context) {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		return TokenAuth(c, token), c
+	}
+	ok, c := auth("bob@my-country-co.com:1234")
+	assert.True(t, ok)
+	assert.Equal(t, "bob@my-country-co.com", c.GetString(authUserKey))
+	assert.Nil(t, authOptions(c))
+
+	ok, c = auth("bob@my-country-co.com-limit-1-session-abc:1234")
+	assert.True(t, ok)
+	assert.Equal(t, "bob@my-country-co.com", c.GetString(authUserKey))
+	assert.Equal(t, url.Values{"limit": {"1"}, "session": {"abc"}}, authOptions(c))
+
+	ok, _ = auth("bob@my-country-co.com:bad")
+	assert.False(t, ok)
+	ok, _ = auth("-limit-1:1234")
+	assert.False(t, ok)
+}
+
+func TestProxyOptions_merge(t *testing.T) {
+	f, err := parseFilter("type=http")
+	assert.Nil(t, err)
+	opts := newProxyOptions()
+	opts.Filter = f
+	assert.Nil(t, opts.merge(url.Values{
+		"type":    {"socks5"},
+		"country": {"us,de"},
+		"limit":   {"1"},
+		"session": {"abc"},
+		"retries": {"0"},
+	}))
+	assert.Equal(t, proxyFilter{
+		{Key: "type", Op: "=", Values: []interface{}{"http"}},
+		{Key: "country", Op: "=", Values: []interface{}{"US", "DE"}},
+	}, opts.Filter)
+	assert.Equal(t, 1, opts.Limit)
+	assert.Equal(t, "abc", opts.Session)
+	assert.Equal(t, 0, opts.Retries)
+
+	// 已经设置过的不覆盖
+	assert.Nil(t, opts.merge(url.Values{"retries": {"3"}}))
+	assert.Equal(t, 0, opts.Retries)
+
+	// 不合法的值
+	assert.NotNil(t, opts.merge(url.Values{"latency": {"abc"}}))
+}
@@ -55,6 +55,9 @@ var (
 	}
 
 	globalCache = cache.New(1*time.Hour, 10*time.Minute) // 全局缓存
+
+	// ErrSkipped 最近已经测试过，在缓存有效期内不再测试
+	ErrSkipped = errors.New("checked recently, skipped")
 )
 
 type respStruct struct {
@@ -81,35 +84,47 @@ func defaultHttpClient(tr *http.Transport) *http.Client {
 type TransportFunc func(addr string) *http.Transport
 
 // Transports is a map of proxy TransportFuncs keyed by their protocol
+// 连接代理时按照DialPolicy检查地址，避免通过检测接口访问内网
 var Transports = map[string]TransportFunc{
 	"http": func(addr string) *http.Transport {
 		u, _ := url.Parse("http://" + addr)
 		return &http.Transport{
-			Proxy: http.ProxyURL(u),
+			Proxy:       http.ProxyURL(u),
+			DialContext: safeDialContext,
 		}
 	},
 	"https": func(addr string) *http.Transport {
 		u, _ := url.Parse("https://" + addr)
 		return &http.Transport{
-			Proxy: http.ProxyURL(u),
+			Proxy:       http.ProxyURL(u),
+			DialContext: safeDialContext,
 		}
 	},
 	"socks4": func(addr string) *http.Transport {
-		return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return socks.Dial("socks4://"+addr)("socks4", addr)
+		return &http.Transport{DialContext: func(ctx context.Context, network, target string) (net.Conn, error) {
+			proxyAddr, err := resolveAllowed(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return socks.Dial("socks4://"+proxyAddr)("socks4", target)
 		},
 		}
 	},
 	"socks4a": func(addr string) *http.Transport {
-		return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return socks.Dial("socks4a://"+addr)("socks4a", addr)
+		return &http.Transport{DialContext: func(ctx context.Context, network, target string) (net.Conn, error) {
+			proxyAddr, err := resolveAllowed(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			return socks.Dial("socks4a://"+proxyAddr)("socks4a", target)
 		},
 		}
 	},
 	"socks5": func(addr string) *http.Transport {
 		u, _ := url.Parse("socks5://" + addr)
 		return &http.Transport{
-			Proxy: http.ProxyURL(u),
+			Proxy:       http.ProxyURL(u),
+			DialContext: safeDialContext,
 		}
 	},
 }
@@ -117,7 +132,7 @@ var Transports = map[string]TransportFunc{
 func SupportHttps(uParsed *url.URL) bool {
 	var err error
 	if transportFunc, ok := Transports[uParsed.Scheme]; ok {
-		client := defaultHttpClient(transportFunc(uParsed.Host))
+		client := defaultHttpClient(transportFunc(userHost(uParsed)))
 
 		var resp *http.Response
 		resp, err = client.Get(defaultHTTPsCheckUrl)
@@ -133,10 +148,18 @@ func SupportHttps(uParsed *url.URL) bool {
 
 // checkProtocolHost 第一个返回参数是是否为代理，第二个返回参数是返回的header
 func checkProtocolHost(protocol string, host string, afterCallback func(string, string, string)) *ProxyResult {
+	// 不允许的地址直接返回，不用连接
+	if err := CheckAddr(host); err != nil {
+		if afterCallback != nil {
+			afterCallback(protocol, host, err.Error())
+		}
+		return &ProxyResult{Error: err}
+	}
+
 	// 确定最近没有进行测试
 	id := protocol + "://" + host
 	if _, found := globalCache.Get(id); found {
-		return nil
+		return &ProxyResult{Error: ErrSkipped}
 	} else {
 		globalCache.Set(id, true, cache.DefaultExpiration)
 	}
@@ -246,6 +269,7 @@ func checkProtocolHost(protocol string, host string, afterCallback func(string,
 }
 
 // checkHost 第一个返回是代理的完整url，第二个返回是header
+// 所有协议都失败时返回其中一个失败的结果，全部在缓存中时Error为ErrSkipped
 func checkHost(host string, afterCallback func(string, string, string)) *ProxyResult {
 	if strings.Contains(host, "://") {
 		return checkUrl(host, afterCallback)
@@ -258,23 +282,26 @@ func checkHost(host string, afterCallback func(string, string, string)) *ProxyRe
 		return checkProtocolHost("http", host+":80", afterCallback)
 	}
 	if strings.Contains(host, "443") {
-		if p := checkProtocolHost("https", host, afterCallback); p != nil && p.Valid {
+		return checkProtocolHost("https", host, afterCallback)
+	}
+
+	var last *ProxyResult
+	for _, protocol := range []string{
+		"http",
+		"socks5",
+		"https",
+		//"socks4",
+	} {
+		p := checkProtocolHost(protocol, host, afterCallback)
+		if p != nil && p.Valid {
 			return p
 		}
-	} else {
-		for _, protocol := range []string{
-			"http",
-			"socks5",
-			"https",
-			//"socks4",
-		} {
-			if p := checkProtocolHost(protocol, host, afterCallback); p != nil && p.Valid {
-				return p
-			}
+		// 只要有一个协议进行了测试，就不算跳过
+		if last == nil || errors.Is(last.Error, ErrSkipped) {
+			last = p
 		}
 	}
-
-	return nil
+	return last
 }
 
 // checkUrl 第一个返回参数是是否为代理，第二个返回参数是返回的header
@@ -294,7 +321,15 @@ func checkUrl(u string, afterCallback func(string, string, string)) *ProxyResult
 	}
 
 	protocol := strings.ToLower(uParsed.Scheme)
-	return checkProtocolHost(protocol, uParsed.Host, afterCallback)
+	return checkProtocolHost(protocol, userHost(uParsed), afterCallback)
+}
+
+// userHost 带有认证信息的host，比如user:pass@1.1.1.1:8080，http/https/socks5的Transports会使用认证信息
+func userHost(u *url.URL) string {
+	if u.User != nil {
+		return u.User.String() + "@" + u.Host
+	}
+	return u.Host
 }
 
 // CheckUrl 根据url进行测试
@@ -302,6 +337,14 @@ func CheckUrl(u string, afterCallback func(string, string, string)) *ProxyResult
 	return checkUrl(u, afterCallback)
 }
 
+// RecheckUrl 不管最近有没有测试过，重新测试url，用于定时检测已经入库的代理
+func RecheckUrl(u string, afterCallback func(string, string, string)) *ProxyResult {
+	if uParsed, err := url.Parse(u); err == nil {
+		globalCache.Delete(strings.ToLower(uParsed.Scheme) + "://" + userHost(uParsed))
+	}
+	return checkUrl(u, afterCallback)
+}
+
 // CheckHost 根据host进行测试
 func CheckHost(host string, afterCallback func(string, string, string)) *ProxyResult {
 	return checkHost(host, afterCallback)
@@ -2,8 +2,11 @@ package checkproxy
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -35,6 +38,28 @@ func (p ProxyAnonymityLevel) String() string {
 	return ""
 }
 
+// ParseProxyAnonymityLevel 解析匿名级别，支持数字，elite/anonymous/transparent/unknown，以及String()的结果
+func ParseProxyAnonymityLevel(s string) (ProxyAnonymityLevel, error) {
+	if v, err := strconv.Atoi(s); err == nil {
+		if v < int(ProxyAnonymityUnknown) || v > int(ProxyAnonymityTransparent) {
+			return ProxyAnonymityUnknown, fmt.Errorf("invalid proxy level: %s", s)
+		}
+		return ProxyAnonymityLevel(v), nil
+	}
+
+	switch strings.TrimPrefix(strings.ToLower(s), "proxyanonymity") {
+	case "unknown":
+		return ProxyAnonymityUnknown, nil
+	case "elite":
+		return ProxyAnonymityElite, nil
+	case "anonymous":
+		return ProxyAnonymityAnonymous, nil
+	case "transparent":
+		return ProxyAnonymityTransparent, nil
+	}
+	return ProxyAnonymityUnknown, fmt.Errorf("invalid proxy level: %s", s)
+}
+
 type ProxyResult struct {
 	Valid          bool                   // 是否代理
 	Cost           time.Duration          // 耗时
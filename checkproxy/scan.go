@@ -0,0 +1,131 @@
+package checkproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange 端口范围，包括首尾
+type portRange struct {
+	from, to int
+}
+
+// Scan 扫描的网段和端口，按需展开成ip:port，不会一次生成所有的地址
+type Scan struct {
+	nets  []*net.IPNet
+	ports []portRange
+	total uint64
+}
+
+// parsePorts 解析端口列表，逗号分割，支持范围，比如：3128,8080,8000-8100
+func parsePorts(s string) ([]portRange, error) {
+	var ports []portRange
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		from, to := v, v
+		if i := strings.Index(v, "-"); i > 0 {
+			from, to = v[:i], v[i+1:]
+		}
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", v, err)
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", v, err)
+		}
+		if f < 1 || t > 65535 || f > t {
+			return nil, fmt.Errorf("invalid port: %s", v)
+		}
+		ports = append(ports, portRange{from: f, to: t})
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no port")
+	}
+	return ports, nil
+}
+
+// NewScan 网段和端口的扫描，网段可以是单个ip，主机位不能超过32位
+func NewScan(cidrs []string, ports string) (*Scan, error) {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no cidr")
+	}
+	s := &Scan{nets: nets}
+	if s.ports, err = parsePorts(ports); err != nil {
+		return nil, err
+	}
+
+	var portCount uint64
+	for _, p := range s.ports {
+		portCount += uint64(p.to - p.from + 1)
+	}
+	for _, n := range s.nets {
+		ones, bits := n.Mask.Size()
+		if bits-ones > 32 {
+			return nil, fmt.Errorf("cidr is too large: %s", n)
+		}
+		s.total += (uint64(1) << uint(bits-ones)) * portCount
+	}
+	return s, nil
+}
+
+// Total 展开后的地址数量
+func (s *Scan) Total() uint64 {
+	return s.total
+}
+
+// nextIP ip加1
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] > 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Iter 依次返回每个ip:port，同一个ip的端口连续，遍历完返回false，不能并发调用
+func (s *Scan) Iter() func() (string, bool) {
+	ni, pi, port := 0, 0, 0
+	var ip net.IP
+	var left uint64 // 当前网段剩余的ip数
+	return func() (string, bool) {
+		for ni < len(s.nets) {
+			if ip == nil {
+				n := s.nets[ni]
+				ones, bits := n.Mask.Size()
+				ip, left, pi, port = n.IP, uint64(1)<<uint(bits-ones), 0, s.ports[0].from
+			}
+			if pi >= len(s.ports) {
+				// 这个ip的端口已经遍历完
+				if left--; left == 0 {
+					ni++
+					ip = nil
+					continue
+				}
+				ip, pi, port = nextIP(ip), 0, s.ports[0].from
+			}
+
+			host := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			if port++; port > s.ports[pi].to {
+				if pi++; pi < len(s.ports) {
+					port = s.ports[pi].from
+				}
+			}
+			return host, true
+		}
+		return "", false
+	}
+}
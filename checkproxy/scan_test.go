@@ -0,0 +1,91 @@
+package checkproxy
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewScan(t *testing.T) {
+	s, err := NewScan([]string{"10.0.0.0/30", "192.168.1.1"}, "80, 8000-8001")
+	assert.Nil(t, err)
+	assert.EqualValues(t, (4+1)*3, s.Total())
+
+	// 同一个ip的端口连续
+	var got []string
+	next := s.Iter()
+	for {
+		addr, ok := next()
+		if !ok {
+			break
+		}
+		got = append(got, addr)
+	}
+	assert.Equal(t, []string{
+		"10.0.0.0:80", "10.0.0.0:8000", "10.0.0.0:8001",
+		"10.0.0.1:80", "10.0.0.1:8000", "10.0.0.1:8001",
+		"10.0.0.2:80", "10.0.0.2:8000", "10.0.0.2:8001",
+		"10.0.0.3:80", "10.0.0.3:8000", "10.0.0.3:8001",
+		"192.168.1.1:80", "192.168.1.1:8000", "192.168.1.1:8001",
+	}, got)
+	// 遍历完之后一直返回false
+	_, ok := next()
+	assert.False(t, ok)
+
+	// 跨过字节边界
+	s, err = NewScan([]string{"10.0.0.255/32", "10.0.1.0/31"}, "1")
+	assert.Nil(t, err)
+	next = s.Iter()
+	for _, want := range []string{"10.0.0.255:1", "10.0.1.0:1", "10.0.1.1:1"} {
+		addr, ok := next()
+		assert.True(t, ok)
+		assert.Equal(t, want, addr)
+	}
+
+	// 遍历的数量跟Total一致
+	s, err = NewScan([]string{"10.0.0.0/22"}, "1-3")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1024*3, s.Total())
+	var n uint64
+	last := ""
+	for next = s.Iter(); ; n++ {
+		addr, ok := next()
+		if !ok {
+			break
+		}
+		last = addr
+	}
+	assert.Equal(t, s.Total(), n)
+	assert.Equal(t, "10.0.3.255:3", last)
+
+	// ipv6的主机位不超过32位
+	s, err = NewScan([]string{"2001:db8::/120"}, "80")
+	assert.Nil(t, err)
+	assert.EqualValues(t, 256, s.Total())
+	addr, _ := s.Iter()()
+	assert.Equal(t, "[2001:db8::]:80", addr)
+	s, err = NewScan([]string{"0.0.0.0/0"}, "1-65535")
+	assert.Nil(t, err)
+	assert.EqualValues(t, uint64(1)<<32*65535, s.Total())
+}
+
+func TestNewScan_invalid(t *testing.T) {
+	tests := []struct {
+		cidrs []string
+		ports string
+	}{
+		{nil, "80"},
+		{[]string{"10.0.0.0/33"}, "80"},
+		{[]string{"abc"}, "80"},
+		{[]string{"2001:db8::/64"}, "80"}, // 主机位超过32位
+		{[]string{"::/0"}, "80"},
+		{[]string{"10.0.0.1"}, ""},
+		{[]string{"10.0.0.1"}, "0"},
+		{[]string{"10.0.0.1"}, "65536"},
+		{[]string{"10.0.0.1"}, "90-80"},
+		{[]string{"10.0.0.1"}, "a-b"},
+	}
+	for _, tt := range tests {
+		_, err := NewScan(tt.cidrs, tt.ports)
+		assert.NotNil(t, err, "%v %s", tt.cidrs, tt.ports)
+	}
+}
@@ -0,0 +1,196 @@
+package checkproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrForbiddenAddress 检测的代理地址不允许连接，比如内网地址
+	ErrForbiddenAddress = errors.New("forbidden address")
+
+	// DefaultDenyCIDRs 默认禁止连接的地址：本机、内网、链路本地（包括云主机的metadata地址）、组播以及保留地址
+	DefaultDenyCIDRs = []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	}
+
+	dialPolicy     = mustDialPolicy(true, nil, DefaultDenyCIDRs)
+	dialPolicyLock sync.RWMutex
+)
+
+// DialPolicy 检测代理时允许连接的地址，Allow优先于Deny，都不匹配的允许
+type DialPolicy struct {
+	Enabled bool
+	Allow   []*net.IPNet
+	Deny    []*net.IPNet
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			// 单个ip
+			if ip := net.ParseIP(s); ip != nil {
+				if ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newDialPolicy(enabled bool, allow, deny []string) (*DialPolicy, error) {
+	allowNets, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyNets, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &DialPolicy{Enabled: enabled, Allow: allowNets, Deny: denyNets}, nil
+}
+
+func mustDialPolicy(enabled bool, allow, deny []string) *DialPolicy {
+	p, err := newDialPolicy(enabled, allow, deny)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// SetDialPolicy 设置检测代理时允许连接的地址，deny为空时使用DefaultDenyCIDRs
+func SetDialPolicy(enabled bool, allow, deny []string) error {
+	if len(deny) == 0 {
+		deny = DefaultDenyCIDRs
+	}
+	p, err := newDialPolicy(enabled, allow, deny)
+	if err != nil {
+		return err
+	}
+	dialPolicyLock.Lock()
+	dialPolicy = p
+	dialPolicyLock.Unlock()
+	return nil
+}
+
+func currentDialPolicy() *DialPolicy {
+	dialPolicyLock.RLock()
+	defer dialPolicyLock.RUnlock()
+	return dialPolicy
+}
+
+// allowed ip是否允许连接
+func (p *DialPolicy) allowed(ip net.IP) bool {
+	if !p.Enabled {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range p.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range p.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// forbidden 拒绝连接的错误，可以用errors.Is(err, ErrForbiddenAddress)判断
+func forbidden(host string, ip net.IP) error {
+	if host == ip.String() {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, host)
+	}
+	return fmt.Errorf("%w: %s (%s)", ErrForbiddenAddress, host, ip)
+}
+
+// resolveAllowed 解析地址并且检查所有的ip，返回第一个ip组成的地址，后续直接连接这个ip，避免再次解析得到不同的结果
+func resolveAllowed(ctx context.Context, addr string) (string, error) {
+	// 去掉认证信息
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		addr = addr[i+1:]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// 没有端口的使用协议默认的端口
+		host, port = strings.Trim(addr, "[]"), ""
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = net.DefaultResolver.LookupIP(ctx, "ip", host); err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no address of %s", host)
+	}
+
+	p := currentDialPolicy()
+	for _, ip := range ips {
+		if !p.allowed(ip) {
+			return "", forbidden(host, ip)
+		}
+	}
+	if port == "" {
+		return ips[0].String(), nil
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// CheckAddr 连接之前检查代理的地址是否允许，addr为host:port格式，可以带有user:pass@，域名会解析后检查所有的ip
+func CheckAddr(addr string) error {
+	_, err := resolveAllowed(context.Background(), addr)
+	return err
+}
+
+// safeDialContext 连接代理，在dns解析之后、建立连接之前检查实际连接的ip
+func safeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout: defaultTimeOut,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !currentDialPolicy().allowed(ip) {
+				return forbidden(addr, net.ParseIP(host))
+			}
+			return nil
+		},
+	}
+	return d.DialContext(ctx, network, addr)
+}
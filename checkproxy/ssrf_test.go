@@ -0,0 +1,124 @@
+package checkproxy
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestCheckAddr(t *testing.T) {
+	t.Cleanup(func() {
+		SetDialPolicy(true, nil, nil)
+	})
+	assert.Nil(t, SetDialPolicy(true, nil, nil))
+
+	tests := []struct {
+		addr      string
+		forbidden bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.1.2.3:8080", true},
+		{"localhost:8080", true}, // 域名解析后检查
+		{"user:pass@127.0.0.1:1080", true},
+		{"169.254.169.254:80", true},
+		{"10.1.2.3:3128", true},
+		{"172.16.0.1:3128", true},
+		{"172.31.255.255:3128", true},
+		{"192.168.1.1:3128", true},
+		{"0.0.0.0:80", true},
+		{"[::1]:80", true},
+		{"[fe80::1]:80", true},
+		{"[fc00::1]:80", true},
+		{"[::ffff:127.0.0.1]:80", true}, // ipv4映射的ipv6地址
+		{"[::ffff:169.254.169.254]:80", true},
+		{"[::ffff:10.0.0.1]:80", true},
+		{"8.8.8.8:53", false},
+		{"172.32.0.1:3128", false},
+		{"1.1.1.1", false},
+		{"[2001:4860:4860::8888]:53", false},
+	}
+	for _, tt := range tests {
+		err := CheckAddr(tt.addr)
+		if tt.forbidden {
+			assert.True(t, errors.Is(err, ErrForbiddenAddress), tt.addr)
+		} else {
+			assert.Nil(t, err, tt.addr)
+		}
+	}
+}
+
+func TestDialPolicy(t *testing.T) {
+	t.Cleanup(func() {
+		SetDialPolicy(true, nil, nil)
+	})
+
+	tests := []struct {
+		enabled bool
+		allow   []string
+		deny    []string
+		addr    string
+		allowed bool
+	}{
+		// allow优先于deny
+		{true, []string{"10.1.0.0/16"}, nil, "10.1.2.3:80", true},
+		{true, []string{"10.1.0.0/16"}, nil, "10.2.0.1:80", false},
+		{true, []string{"127.0.0.1"}, nil, "127.0.0.1:80", true},
+		{true, []string{"127.0.0.1"}, nil, "127.0.0.2:80", false},
+		{true, []string{"127.0.0.1"}, nil, "[::ffff:127.0.0.1]:80", true},
+		// 自定义deny替换默认的列表
+		{true, nil, []string{"8.8.8.0/24"}, "8.8.8.8:53", false},
+		{true, nil, []string{"8.8.8.0/24"}, "127.0.0.1:80", true},
+		{true, []string{"8.8.8.8"}, []string{"8.8.8.0/24"}, "8.8.8.8:53", true},
+		// 关闭后都允许
+		{false, nil, nil, "127.0.0.1:80", true},
+		{false, nil, nil, "169.254.169.254:80", true},
+	}
+	for _, tt := range tests {
+		assert.Nil(t, SetDialPolicy(tt.enabled, tt.allow, tt.deny))
+		err := CheckAddr(tt.addr)
+		if tt.allowed {
+			assert.Nil(t, err, "%v %v %s", tt.allow, tt.deny, tt.addr)
+		} else {
+			assert.True(t, errors.Is(err, ErrForbiddenAddress), "%v %v %s", tt.allow, tt.deny, tt.addr)
+		}
+	}
+
+	assert.NotNil(t, SetDialPolicy(true, []string{"abc"}, nil))
+	assert.NotNil(t, SetDialPolicy(true, nil, []string{"10.0.0.0/33"}))
+}
+
+func TestSafeDialContext(t *testing.T) {
+	t.Cleanup(func() {
+		SetDialPolicy(true, nil, nil)
+	})
+	assert.Nil(t, SetDialPolicy(true, nil, nil))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// 连接之前检查实际的ip，域名解析到内网地址（dns rebinding）也会被拒绝
+	for _, addr := range []string{ln.Addr().String(), net.JoinHostPort("localhost", port)} {
+		_, err = safeDialContext(context.Background(), "tcp", addr)
+		assert.True(t, errors.Is(err, ErrForbiddenAddress), addr)
+	}
+
+	// 允许之后可以连接
+	assert.Nil(t, SetDialPolicy(true, []string{"127.0.0.1"}, nil))
+	conn, err := safeDialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	if assert.Nil(t, err) {
+		conn.Close()
+	}
+}
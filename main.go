@@ -4,13 +4,16 @@ import (
 	"fmt"
 	"github.com/LubyRuffy/myip/ipdb"
 	"github.com/LubyRuffy/rproxy/api"
+	"github.com/LubyRuffy/rproxy/checkproxy"
 	"github.com/LubyRuffy/rproxy/models"
 	"github.com/LubyRuffy/rproxy/utils"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
 func init() {
@@ -26,6 +29,26 @@ func main() {
 	viper.SetDefault("debug.dbsql", false)
 	viper.SetDefault("tls", false)
 	viper.SetDefault("logerror", false)
+	viper.SetDefault("socks5", "")
+	viper.SetDefault("session.ttl", "10m")
+	viper.SetDefault("strategy", "random")
+	viper.SetDefault("retries", 2)
+	viper.SetDefault("ban.status", []int{403, 429})
+	viper.SetDefault("ban.cooldown", "30m")
+	viper.SetDefault("accesslog.enabled", true)
+	viper.SetDefault("accesslog.retention", "168h")
+	viper.SetDefault("accesslog.maxrows", 1000000)
+	viper.SetDefault("ssrf.enabled", true)
+	viper.SetDefault("checkjob.maxtargets", 10000)
+	viper.SetDefault("checkjob.ttl", "24h")
+	viper.SetDefault("checkjob.concurrency", 20)
+	viper.SetDefault("checkjob.maxscan", 1<<18)
+	viper.SetDefault("checkjob.maxperuser", 5)
+	viper.SetDefault("revalidate.interval", "30m")
+	viper.SetDefault("revalidate.failing", "5m")
+	viper.SetDefault("revalidate.jitter", "5m")
+	viper.SetDefault("revalidate.concurrency", 10)
+	viper.SetDefault("revalidate.skipused", "1m")
 
 	viper.AddConfigPath(filepath.Dir(os.Args[0]))
 	viper.SetConfigType("yaml")
@@ -35,6 +58,10 @@ func main() {
 	pflag.Bool("logerror", false, "enable error check log")
 	pflag.String("addr", ":8088", "bind addr")
 	pflag.String("dbfile", "rproxy.sqlite", "sqlite database file")
+	pflag.String("socks5", "", "socks5 bind addr, empty means disabled")
+	pflag.String("import", "", "import proxy list file, check and save to the user of --import-user, then exit")
+	pflag.String("import-user", "", "email of the user to import proxies to")
+	pflag.String("import-format", "", "format of the import file: txt/csv/clash/json, empty means auto detect")
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
@@ -58,12 +85,98 @@ func main() {
 	if viper.GetBool("tls") {
 		api.EnableTls = true
 	}
+	if addr := viper.GetString("socks5"); addr != "" {
+		api.Socks5Addr = addr
+	}
+	if ttl := viper.GetDuration("session.ttl"); ttl > 0 {
+		api.SessionTTL = ttl
+	}
+	if strategy := viper.GetString("strategy"); strategy != "" {
+		if _, ok := api.Strategies[strategy]; !ok {
+			log.Fatalln("unknown strategy:", strategy)
+		}
+		api.DefaultStrategy = strategy
+	}
+	if retries := viper.GetInt("retries"); retries >= 0 {
+		api.DefaultRetries = retries
+	}
+	var users []*api.UserSetting
+	if err = viper.UnmarshalKey("users", &users); err != nil {
+		log.Fatalln("load user settings failed:", err)
+	}
+	api.SetUserSettings(users)
+	if err = viper.UnmarshalKey("cooldown", &api.DefaultCooldown); err != nil {
+		log.Fatalln("load cooldown failed:", err)
+	}
+	if err = viper.UnmarshalKey("quota", &api.DefaultQuota); err != nil {
+		log.Fatalln("load quota failed:", err)
+	}
+	if err = viper.UnmarshalKey("ratelimit", &api.DefaultRateLimits); err != nil {
+		log.Fatalln("load rate limits failed:", err)
+	}
+	var routes []*api.Route
+	if err = viper.UnmarshalKey("routes", &routes); err != nil {
+		log.Fatalln("load routes failed:", err)
+	}
+	if err = api.SetRoutes(routes); err != nil {
+		log.Fatalln(err)
+	}
+	if err = checkproxy.SetDialPolicy(viper.GetBool("ssrf.enabled"),
+		viper.GetStringSlice("ssrf.allow"), viper.GetStringSlice("ssrf.deny")); err != nil {
+		log.Fatalln("load ssrf policy failed:", err)
+	}
+	var banRules api.BanRules
+	if err = viper.UnmarshalKey("ban", &banRules); err != nil {
+		log.Fatalln("load ban rules failed:", err)
+	}
+	if err = api.SetBanRules(&banRules); err != nil {
+		log.Fatalln(err)
+	}
+	api.AccessLogEnabled = viper.GetBool("accesslog.enabled")
+	api.AccessLogRetention = viper.GetDuration("accesslog.retention")
+	api.AccessLogMaxRows = viper.GetInt("accesslog.maxrows")
+	api.MaxCheckJobTargets = viper.GetInt("checkjob.maxtargets")
+	api.CheckJobTTL = viper.GetDuration("checkjob.ttl")
+	if n := viper.GetInt("checkjob.concurrency"); n > 0 {
+		api.CheckJobConcurrency = n
+	}
+	api.MaxScanTargets = viper.GetInt("checkjob.maxscan")
+	api.MaxCheckJobsPerUser = viper.GetInt("checkjob.maxperuser")
+	api.RevalidateInterval = viper.GetDuration("revalidate.interval")
+	api.RevalidateFailingInterval = viper.GetDuration("revalidate.failing")
+	api.RevalidateJitter = viper.GetDuration("revalidate.jitter")
+	api.RevalidateConcurrency = viper.GetInt("revalidate.concurrency")
+	api.RevalidateSkipUsed = viper.GetDuration("revalidate.skipused")
 	if viper.GetBool("debug.gin") {
 		api.EnableDebug = true
 	}
 
+	// 导入代理列表，检测完成后退出
+	if file := viper.GetString("import"); file != "" {
+		err = api.ImportFile(file, viper.GetString("import-format"), viper.GetString("import-user"))
+		api.Stop()
+		if err != nil {
+			log.Fatalln("import failed:", err)
+		}
+		return
+	}
+
+	// 退出时停止服务，把还没写入的统计数据写入数据库
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("shutting down...")
+		if err := api.Stop(); err != nil {
+			log.Println("stop failed:", err)
+		}
+		close(stopped)
+	}()
+
 	// 启动web
 	if err = api.Start(viper.GetString("addr")); err != nil {
 		panic(err)
 	}
+	<-stopped
 }
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// AccessLog 代理请求的访问日志表，按照保留策略定期删除，所以不用软删除
+type AccessLog struct {
+	ID        uint      `json:"id" gorm:"primarykey"`
+	CreatedAt time.Time `json:"created_at" gorm:"index"` //请求开始时间
+	UserID    uint      `json:"user_id" gorm:"index"`    //用户id
+	Host      string    `json:"host" gorm:"index"`       //目标域名，不带端口
+	Method    string    `json:"method"`                  //请求方法，隧道为CONNECT
+	Status    int       `json:"status"`                  //返回给客户端的响应码
+	BytesIn   int64     `json:"bytes_in"`                //从上游收到的字节数
+	BytesOut  int64     `json:"bytes_out"`               //发给上游的字节数
+	ProxyID   uint      `json:"proxy_id"`                //使用的上游代理，0表示没有选到代理
+	Duration  int64     `json:"duration"`                //耗时，单位为ms
+	Error     string    `json:"error"`                   //错误信息
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"github.com/LubyRuffy/rproxy/checkproxy"
 	"github.com/glebarez/sqlite"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
@@ -40,7 +41,7 @@ func TestSetupDB(t *testing.T) {
 		ProxyURL:     "http://127.0.0.1:8080",
 		Http:         true,
 		Connect:      false,
-		ProxyLevel:   ProxyAnonymityTransparent,
+		ProxyLevel:   checkproxy.ProxyAnonymityTransparent,
 		SuccessCount: 0,
 		FailedCount:  0,
 	})
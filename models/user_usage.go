@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// UserUsage 用户每天和每月的流量以及请求数，Period为2006-01-02或者2006-01
+type UserUsage struct {
+	ID        uint      `json:"-" gorm:"primarykey"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    uint      `json:"user_id" gorm:"uniqueIndex:idx_user_period,priority:1"` //用户id
+	Period    string    `json:"period" gorm:"uniqueIndex:idx_user_period,priority:2"`  //统计周期
+	Bytes     int64     `json:"bytes"`                                                 //收发的字节数
+	Requests  int64     `json:"requests"`                                              //请求数
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/LubyRuffy/rproxy/checkproxy"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 /*
@@ -18,12 +20,47 @@ jq -s -r 'group_by(.ip)| map({ ip: (.[0].ip), host: (.[0].host) }) | .[] |.host'
 - 先利用gofofa的客户端，提取所有有正确证书的对应真实域名的可能是代理的host列表；
 - 再利用jq根据ip去重，只提取一条host进行请求验证
 */
+
+// checkAll 并发检测next返回的所有host，total大于0时在stderr输出进度
+func checkAll(next func() (string, bool), total uint64) {
+	queueCh := make(chan string, 10)
+	var wg sync.WaitGroup
+	var done, valid uint64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queueCh {
+				r := checkproxy.CheckHost(host, nil)
+				n := atomic.AddUint64(&done, 1)
+				if r != nil && r.Valid {
+					atomic.AddUint64(&valid, 1)
+					os.Stderr.WriteString("\n")
+					fmt.Println(r)
+				} else if total == 0 {
+					os.Stderr.WriteString(".")
+				}
+				if total > 0 {
+					fmt.Fprintf(os.Stderr, "\rprogress: %d/%d, valid: %d", n, total, atomic.LoadUint64(&valid))
+				}
+			}
+		}()
+	}
+	for host, ok := next(); ok; host, ok = next() {
+		queueCh <- host
+	}
+	close(queueCh)
+	wg.Wait()
+}
+
 func main() {
 	proxy := flag.String("proxy", "", "")
 	file := flag.String("file", "", "")
+	cidr := flag.String("cidr", "", "cidr list to scan, separated by comma, e.g. 1.1.1.0/24,2.2.2.2")
+	ports := flag.String("ports", "3128,8080,1080", "port list or ranges to scan, e.g. 3128,8000-8100")
 	flag.Parse()
 
-	if *proxy == "" && *file == "" {
+	if *proxy == "" && *file == "" && *cidr == "" {
 		panic("no proxy to check")
 	}
 	checkproxy.GetPublicIP()
@@ -33,6 +70,16 @@ func main() {
 		return
 	}
 
+	if *cidr != "" {
+		scan, err := checkproxy.NewScan(strings.Split(*cidr, ","), *ports)
+		if err != nil {
+			log.Fatal(err)
+		}
+		checkAll(scan.Iter(), scan.Total())
+		os.Stderr.WriteString("\n")
+		return
+	}
+
 	if *file != "" {
 		file, err := os.Open(*file)
 		if err != nil {
@@ -40,28 +87,12 @@ func main() {
 		}
 		defer file.Close()
 		scanner := bufio.NewScanner(file)
-		queueCh := make(chan string, 10)
-		var wg sync.WaitGroup
-		for i := 0; i < 10; i++ {
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				for host := range queueCh {
-					r := checkproxy.CheckHost(host, nil)
-					if r.Valid {
-						os.Stderr.WriteString("\n")
-						fmt.Println(r)
-					} else {
-						os.Stderr.WriteString(".")
-					}
-				}
-			}()
-		}
-		for scanner.Scan() {
-			queueCh <- scanner.Text()
-		}
-		close(queueCh)
-		wg.Wait()
+		checkAll(func() (string, bool) {
+			if scanner.Scan() {
+				return scanner.Text(), true
+			}
+			return "", false
+		}, 0)
 
 		if err := scanner.Err(); err != nil {
 			log.Fatal(err)